@@ -2,6 +2,10 @@ package query
 
 import (
 	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 type ValueType uint
@@ -16,19 +20,181 @@ const (
 	VTObjectID
 	VTBool
 	VTArray
+	VTNode
+	VTCalc
+	VTParam
+	VTArrayParam
+	VTGeo
+	VTText
+	VTNull
+	VTDecimal
+	VTInt32
+	VTInt64
+	VTUUID
+	VTBinary
+	VTTimestamp
+	VTMinKey
+	VTMaxKey
+	// VTDuration is a duration literal like 7d (nanoseconds).
+	VTDuration
+	// VTTimeCalc is a date arithmetic evaluated at compile time.
+	VTTimeCalc
+	// VTVar is an aggregation variable like $$NOW.
+	VTVar
+	// VTCalendar is a calendar period like TODAY() or MONTH("2022-01").
+	VTCalendar
+	// VTDocument is an embedded document literal like {street: "Main", no: 5}.
+	VTDocument
+	// VTJSON is an extended JSON fragment `JSON({...})`.
+	VTJSON
 )
 
 type Expression struct {
-	Op    string
-	L     []byte
-	LT    ValueType
-	R     []byte
-	RT    ValueType
-	S, T  pos
-	Links *[]*Expression
+	Op string
+	L  []byte
+	LT ValueType
+	R  []byte
+	RT ValueType
+	// RN is a nested block of array quantifier (RT is VTNode).
+	RN *Node
+	// LC and RC are calculated operands (LT or RT is VTCalc).
+	LC, RC *Calc
+	// G is a geometry of geospatial predicate (RT is VTGeo).
+	G *Geo
+	// Text is a full-text search clause (RT is VTText).
+	Text *Text
+	// Cal is a calendar period (RT is VTCalendar).
+	Cal *Calendar
+	// JSON is a parsed extended JSON fragment (RT is VTJSON), it is
+	// spliced into query or used as operators document of field L.
+	JSON bson.D
+	// Optional are parameters of optional clause (Op is "optional",
+	// clause is RN), clause is removed at compile time if any of them is omitted.
+	Optional []string
+	S, T     pos
+	Links    *[]*Expression
+}
+
+// Calc is an arithmetic operation or function call used as an
+// operand of expression. Leaf Calc (without Op) holds single value.
+type Calc struct {
+	// Op is an arithmetic operator (+, -, *, /, %) or function name.
+	Op   string
+	Args []*Calc
+	V    []byte
+	VT   ValueType
+}
+
+// TimeCalc reports whether calc is a date arithmetic without fields
+// (like `NOW() - 7d` or `$start + 2h`) that is evaluated at compile time.
+func (c *Calc) TimeCalc() bool {
+	if c.Op == "" {
+		return false
+	}
+
+	var hasTime bool
+
+	var walk func(c *Calc) bool
+	walk = func(c *Calc) bool {
+		switch c.Op {
+		case "":
+			hasTime = hasTime || c.VT == VTDuration
+			return c.VT != VTKey && c.VT != VTVar
+		case "now", "NOW":
+			hasTime = true
+			return true
+		case "+", "-":
+			for _, a := range c.Args {
+				if !walk(a) {
+					return false
+				}
+			}
+
+			return true
+		}
+
+		return false
+	}
+
+	return walk(c) && hasTime
+}
+
+func (c *Calc) String() string {
+	if c == nil {
+		return "<nil>"
+	}
+
+	if c.Op == "" {
+		if c.VT == VTKey || c.VT == VTString {
+			return string(c.V)
+		}
+
+		return fmt.Sprintf("%X", c.V)
+	}
+
+	args := make([]string, 0, len(c.Args))
+	for _, a := range c.Args {
+		args = append(args, a.String())
+	}
+
+	return fmt.Sprintf("%s(%s)", c.Op, strings.Join(args, ", "))
+}
+
+// Geo is a geometry operand of NEAR, WITHIN and INTERSECTS predicates.
+type Geo struct {
+	// Type is GeoJSON type (Point or Polygon) or Circle.
+	Type string
+	// Coords are points of geometry, polygon ring is closed.
+	Coords [][2]float64
+	// Radius of Circle in meters.
+	Radius float64
+	// Param is a name of parameter with geometry (Type is empty).
+	Param string
+	// Dist is max distance of NEAR in meters (VTFloat) or parameter (VTParam).
+	Dist  []byte
+	DistT ValueType
+}
+
+// Text is a full-text search clause
+// `TEXT("coffee shop" LANGUAGE "en" CASE_SENSITIVE DIACRITIC_SENSITIVE)`.
+type Text struct {
+	// Search is a search string (VTString) or parameter (VTParam).
+	Search  []byte
+	SearchT ValueType
+	// Language is optional language of search, string or parameter.
+	Language           []byte
+	LanguageT          ValueType
+	CaseSensitive      bool
+	DiacriticSensitive bool
+}
+
+// Calendar is a period of TODAY(), DAY(), WEEK(), MONTH() or YEAR()
+// that is expanded at compile time to half-open date range.
+type Calendar struct {
+	// Unit is one of calendarUnits.
+	Unit string
+	// Date is any date within period: date (VTDate), date string (VTString)
+	// or parameter (VTParam). Current date is used if it is empty.
+	Date  []byte
+	DateT ValueType
+	// Loc is a time zone of period.
+	Loc *time.Location
+	// ZoneParam is a name of parameter with time zone (overrides Loc).
+	ZoneParam string
 }
 
+var (
+	keyExpr = []byte("$expr")
+	keyText = []byte("$text")
+)
+
+// FindKey returns field the expression refers to.
+// Aggregation expressions refer to $expr.
 func (e *Expression) FindKey() []byte {
+	if e.Aggregation() {
+		return keyExpr
+	}
+
 	if e.LT == VTKey {
 		return e.L
 	}
@@ -40,6 +206,21 @@ func (e *Expression) FindKey() []byte {
 	return nil
 }
 
+// Aggregation reports whether expression should be written as
+// aggregation expression ($expr), that is when it has calculated operand
+// or compares two fields.
+func (e *Expression) Aggregation() bool {
+	return e.LT == VTCalc || e.RT == VTCalc ||
+		e.LT == VTVar || e.RT == VTVar ||
+		e.FieldComparison()
+}
+
+// FieldComparison reports whether expression compares two fields
+// (like `updatedAt > createdAt`).
+func (e *Expression) FieldComparison() bool {
+	return e.LT == VTKey && e.RT == VTKey
+}
+
 func (e *Expression) String() string {
 	ls := ""
 	if e.LT == VTKey ||
@@ -49,6 +230,20 @@ func (e *Expression) String() string {
 		ls = fmt.Sprintf("%X", e.L)
 	}
 
+	if e.LT == VTCalc {
+		ls = e.LC.String()
+	}
+
+	if e.RT == VTNode {
+		return fmt.Sprintf("%s %s (%s) links: %v",
+			ls, e.Op, e.RN, e.Links)
+	}
+
+	if e.RT == VTCalc {
+		return fmt.Sprintf("%s %s %s links: %v",
+			ls, e.Op, e.RC, e.Links)
+	}
+
 	return fmt.Sprintf("%s %s %X links: %v",
 		ls, e.Op, e.R, e.Links)
 }
@@ -63,7 +258,9 @@ type Node struct {
 	Op     string
 	L, R   *Expression
 	LN, RN *Node
-	LRoot  bool
+	// Deprecated: LRoot is not set, parser builds tree by operator
+	// precedence and does not mark roots of parentheses.
+	LRoot bool
 }
 
 func (n *Node) String() string {
@@ -114,10 +311,13 @@ func (n *Node) Root() *Node {
 
 // LocalRoot finds local root (parent node for parentheses)
 // and flag if we found local root from left side.
+//
+// Deprecated: parser does not mark local roots (see LRoot),
+// nil is returned if there is no marked node.
 func (n *Node) LocalRoot() (*Node, bool) {
 	var pn *Node
 
-	for {
+	for n != nil {
 		if n.LRoot {
 			return n, n.LN == pn
 		}
@@ -125,8 +325,12 @@ func (n *Node) LocalRoot() (*Node, bool) {
 		pn = n
 		n = n.Parent
 	}
+
+	return nil, false
 }
 
+// Deprecated: SetNextExpression was used by previous parser,
+// set L or R field instead.
 func (n *Node) SetNextExpression(ne *Expression) {
 	if n.L == nil && n.LN == nil {
 		n.L = ne
@@ -135,11 +339,15 @@ func (n *Node) SetNextExpression(ne *Expression) {
 	}
 }
 
+// Deprecated: ReplaceNode was used by previous parser,
+// set LN or RN field of parent and call FixParent instead.
 func (n *Node) ReplaceNode(nn *Node) {
 	n.Parent.Replace(n, nn)
 	nn.Parent = n.Parent
 }
 
+// Deprecated: SetNextNode was used by previous parser,
+// set LN or RN field and call FixParent instead.
 func (n *Node) SetNextNode(nn *Node) {
 	if n.L == nil && n.LN == nil {
 		n.LN = nn
@@ -150,6 +358,8 @@ func (n *Node) SetNextNode(nn *Node) {
 	nn.Parent = n
 }
 
+// Deprecated: Replace was used by previous parser,
+// set LN or RN field instead.
 func (n *Node) Replace(on, nn *Node) {
 	if n.LN == on {
 		n.LN = nn
@@ -158,12 +368,29 @@ func (n *Node) Replace(on, nn *Node) {
 	}
 }
 
+// Compact links expressions and reduces tree with root r.
+func Compact(r *Node) *Node {
+	r.Parent = nil
+
+	Link(r)
+	r = Reduce(r)
+	r.Parent = nil
+	r.FixParent()
+
+	return r
+}
+
 func Reduce(n *Node) *Node {
-	rn, _ := reduce(n)
+	rn, e := reduce(n)
 	if rn != nil {
 		return rn
 	}
 
+	if e != nil {
+		// tree is reduced to single expression
+		return &Node{Op: "and", L: e}
+	}
+
 	return n
 }
 
@@ -183,6 +410,20 @@ func reduce(n *Node) (*Node, *Expression) {
 		return nil, nil
 	}
 
+	if n.Op == "not" {
+		// double negation
+		if n.LN != nil && n.LN.Op == "not" {
+			if n.LN.LN != nil {
+				return n.LN.LN, nil
+			}
+
+			return nil, n.LN.L
+		}
+
+		// "not" node is never collapsed, it has only one operand
+		return n, nil
+	}
+
 	if !lempty && !rempty {
 		return n, nil
 	}
@@ -220,38 +461,42 @@ type linkMap map[string]*Expression
 // linkNode finds expressions that refers same key.
 // All linked expressions gathered to firs expression, and removed from
 // original nodes.
+// Expressions are never linked across "or" branches or "not" boundary.
 func (lm linkMap) linkNode(n *Node) {
-	if n.L != nil {
-		linked := lm.linkExpression(n.L)
-		if linked {
-			n.L = nil
-		}
+	if n.Op == "not" {
+		lm = newLinkMap()
 	}
 
-	if n.R != nil {
-		linked := lm.linkExpression(n.R)
+	llm := lm
+	if n.Op == "or" {
+		llm = newLinkMap()
+	}
+
+	if n.L != nil {
+		linked := llm.linkExpression(n.L)
 		if linked {
-			n.R = nil
+			n.L = nil
 		}
 	}
 
 	if n.LN != nil {
-		llm := lm
-		if n.Op == "or" {
-			llm = newLinkMap()
-		}
-
 		llm.linkNode(n.LN)
 	}
 
-	if n.RN != nil {
-		llm := lm
+	rlm := lm
+	if n.Op == "or" {
+		rlm = newLinkMap()
+	}
 
-		if n.Op == "or" {
-			llm = newLinkMap()
+	if n.R != nil {
+		linked := rlm.linkExpression(n.R)
+		if linked {
+			n.R = nil
 		}
+	}
 
-		llm.linkNode(n.RN)
+	if n.RN != nil {
+		rlm.linkNode(n.RN)
 	}
 }
 
@@ -268,6 +513,13 @@ func (lm linkMap) linkExpression(e *Expression) bool {
 			ee.Links = &[]*Expression{}
 		}
 		*ee.Links = append(*ee.Links, e)
+
+		// expression may be already linked (like range `1 < a < 5`)
+		if e.Links != nil {
+			*ee.Links = append(*ee.Links, *e.Links...)
+			e.Links = nil
+		}
+
 		return true
 	}
 
@@ -7,13 +7,17 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -23,8 +27,19 @@ var (
 	}}
 )
 
-func MustPrepare(query string) *PreparedQuery {
-	pq, err := Prepare(query)
+// Option changes parsing of query by Prepare.
+type Option func(p *Parser)
+
+// WithLocation sets time zone of dates without offset and calendar
+// periods without zone (DefaultLocation is used otherwise).
+func WithLocation(loc *time.Location) Option {
+	return func(p *Parser) {
+		p.SetLocation(loc)
+	}
+}
+
+func MustPrepare(query string, opts ...Option) *PreparedQuery {
+	pq, err := Prepare(query, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -32,26 +47,41 @@ func MustPrepare(query string) *PreparedQuery {
 	return pq
 }
 
-func Prepare(query string) (*PreparedQuery, error) {
+func Prepare(query string, opts ...Option) (*PreparedQuery, error) {
 	s := NewScanner(strings.NewReader(query))
 	p := NewParser(s)
 
+	for _, opt := range opts {
+		opt(p)
+	}
+
 	n, err := p.Parse()
 	if err != nil {
 		return nil, err
 	}
 
-	return &PreparedQuery{n}, nil
+	pq := &PreparedQuery{node: n, params: p.Params(), collation: p.Collation()}
+	optionalParams(n, &pq.optional)
+
+	return pq, nil
 }
 
 type CompiledQuery struct {
-	buff *bytes.Buffer
+	buff      *bytes.Buffer
+	collation *options.Collation
 }
 
 func (pq CompiledQuery) MarshalBSON() ([]byte, error) {
 	return pq.buff.Bytes(), nil
 }
 
+// Collation returns collation set by COLLATE clause or nil,
+// it should be passed to operation along with query
+// (like options.Find().SetCollation(q.Collation())).
+func (pq CompiledQuery) Collation() *options.Collation {
+	return pq.collation
+}
+
 func (pq CompiledQuery) Discard() {
 	buffPool.Put(pq.buff)
 }
@@ -75,7 +105,29 @@ func Compile(query string, params ...interface{}) (CompiledQuery, error) {
 }
 
 type PreparedQuery struct {
-	node *Node
+	node   *Node
+	params map[string]Param
+	// optional are parameters of optional clauses.
+	optional  map[string]bool
+	clock     func() time.Time
+	collation *options.Collation
+}
+
+// WithClock returns copy of prepared query that uses clock
+// to evaluate NOW() instead of time.Now.
+func (enc PreparedQuery) WithClock(clock func() time.Time) *PreparedQuery {
+	enc.clock = clock
+	return &enc
+}
+
+// Params returns typed parameter declarations of query.
+func (enc PreparedQuery) Params() map[string]Param {
+	return enc.params
+}
+
+// Collation returns collation set by COLLATE clause or nil.
+func (enc PreparedQuery) Collation() *options.Collation {
+	return enc.collation
 }
 
 func (enc PreparedQuery) Compile(params ...interface{}) (CompiledQuery, error) {
@@ -84,23 +136,310 @@ func (enc PreparedQuery) Compile(params ...interface{}) (CompiledQuery, error) {
 		return CompiledQuery{}, err
 	}
 
+	node := enc.node
+	if len(enc.optional) > 0 {
+		node = Compact(dropOptional(node, func(name string) bool {
+			return omittedParam(enc.params, prmMap, name)
+		}))
+	}
+
+	prmMap, err = applyParams(enc.params, enc.optional, prmMap)
+	if err != nil {
+		return CompiledQuery{}, err
+	}
+
 	buff := buffPool.Get().(*bytes.Buffer)
 	buff.Reset()
 
 	vw := bvwPool.Get(buff)
 	defer bvwPool.Put(vw)
 
+	now := time.Now
+	if enc.clock != nil {
+		now = enc.clock
+	}
+
 	wc := writeContext{
-		vw: vw,
-		ec: bsoncodec.EncodeContext{Registry: bson.DefaultRegistry},
+		vw:         vw,
+		ec:         bsoncodec.EncodeContext{Registry: bson.DefaultRegistry},
+		now:        now(),
+		ignoreCase: enc.collation != nil && (enc.collation.Strength == 1 || enc.collation.Strength == 2),
 	}
 
-	err = encodeQuery(wc, enc.node, prmMap)
+	err = encodeQuery(wc, node, prmMap)
 	if err != nil {
 		return CompiledQuery{}, err
 	}
 
-	return CompiledQuery{buff}, nil
+	return CompiledQuery{buff: buff, collation: enc.collation}, nil
+}
+
+// optionalParams collects parameters of optional clauses.
+func optionalParams(n *Node, params *map[string]bool) {
+	if n == nil {
+		return
+	}
+
+	for _, e := range []*Expression{n.L, n.R} {
+		if e == nil || e.RT != VTNode {
+			continue
+		}
+
+		for _, name := range e.Optional {
+			if *params == nil {
+				*params = make(map[string]bool)
+			}
+
+			(*params)[name] = true
+		}
+
+		optionalParams(e.RN, params)
+	}
+
+	optionalParams(n.LN, params)
+	optionalParams(n.RN, params)
+}
+
+// dropOptional returns copy of tree where optional clauses with omitted
+// parameters are removed and other optional clauses are replaced
+// with their content. Tree should be compacted after it.
+func dropOptional(n *Node, omitted func(string) bool) *Node {
+	if n == nil {
+		return nil
+	}
+
+	c := *n
+	c.LN = dropOptional(n.LN, omitted)
+	c.RN = dropOptional(n.RN, omitted)
+
+	var ln, rn *Node
+
+	c.L, ln = dropOptionalExpression(n.L, omitted)
+	if ln != nil {
+		c.LN = ln
+	}
+
+	c.R, rn = dropOptionalExpression(n.R, omitted)
+	if rn != nil {
+		c.RN = rn
+	}
+
+	return &c
+}
+
+// dropOptionalExpression returns copy of expression or content of
+// optional clause.
+func dropOptionalExpression(e *Expression, omitted func(string) bool) (*Expression, *Node) {
+	if e == nil {
+		return nil, nil
+	}
+
+	if e.Op == "optional" {
+		for _, name := range e.Optional {
+			if omitted(name) {
+				return nil, nil
+			}
+		}
+
+		return nil, dropOptional(e.RN, omitted)
+	}
+
+	ce := *e
+
+	if ce.RT == VTNode {
+		ce.RN = Compact(dropOptional(e.RN, omitted))
+
+		// quantifier without content matches not what was meant
+		if emptyNode(ce.RN) {
+			return nil, nil
+		}
+	}
+
+	if e.Links != nil {
+		links := make([]*Expression, 0, len(*e.Links))
+		for _, le := range *e.Links {
+			le, _ = dropOptionalExpression(le, omitted)
+			if le != nil {
+				links = append(links, le)
+			}
+		}
+
+		ce.Links = &links
+	}
+
+	return &ce, nil
+}
+
+// And returns prepared query that matches documents matched by all queries.
+func And(pqs ...*PreparedQuery) (*PreparedQuery, error) {
+	return compose("and", pqs)
+}
+
+// Or returns prepared query that matches documents matched by any of queries.
+func Or(pqs ...*PreparedQuery) (*PreparedQuery, error) {
+	return compose("or", pqs)
+}
+
+// Not returns prepared query that matches documents not matched by pq.
+func Not(pq *PreparedQuery) (*PreparedQuery, error) {
+	return compose("not", []*PreparedQuery{pq})
+}
+
+// And returns prepared query that matches documents matched
+// by query and all others.
+func (enc PreparedQuery) And(others ...*PreparedQuery) (*PreparedQuery, error) {
+	return compose("and", append([]*PreparedQuery{&enc}, others...))
+}
+
+// Or returns prepared query that matches documents matched
+// by query or any of others.
+func (enc PreparedQuery) Or(others ...*PreparedQuery) (*PreparedQuery, error) {
+	return compose("or", append([]*PreparedQuery{&enc}, others...))
+}
+
+// compose joins copies of query trees with op node and merges
+// their parameters, queries are not modified. Joined tree is linked
+// and reduced again, so result is the same as of queries joined in text.
+func compose(op string, pqs []*PreparedQuery) (*PreparedQuery, error) {
+	if len(pqs) == 0 {
+		return nil, errors.New("no queries to compose")
+	}
+
+	c := &PreparedQuery{}
+
+	var n *Node
+
+	for _, pq := range pqs {
+		err := mergeQuery(c, pq)
+		if err != nil {
+			return nil, err
+		}
+
+		pn := cloneNode(pq.node)
+
+		// empty query matches everything
+		if emptyNode(pn) {
+			if op == "or" {
+				return &PreparedQuery{node: &Node{}, clock: c.clock, collation: c.collation}, nil
+			}
+
+			if op == "and" {
+				continue
+			}
+
+			return nil, errors.New("empty query can not be negated")
+		}
+
+		if n == nil {
+			n = pn
+			continue
+		}
+
+		n = &Node{Op: op, LN: n, RN: pn}
+	}
+
+	if n == nil {
+		n = &Node{}
+	}
+
+	if op == "not" {
+		n = &Node{Op: op, LN: n}
+	}
+
+	n = Compact(n)
+
+	var text bool
+
+	err := checkTextNode(n, "", &text)
+	if err != nil {
+		return nil, err
+	}
+
+	c.node = n
+
+	return c, nil
+}
+
+// mergeQuery adds parameters and settings of pq to c, parameter declared
+// in both queries should have the same type and default, collations
+// should be the same.
+func mergeQuery(c, pq *PreparedQuery) error {
+	for name, prm := range pq.params {
+		if c.params == nil {
+			c.params = make(map[string]Param)
+		}
+
+		prev, ok := c.params[name]
+		if ok && !prev.same(prm) {
+			return fmt.Errorf("parameter %s redeclared", name)
+		}
+
+		c.params[name] = prm
+	}
+
+	for name := range pq.optional {
+		if c.optional == nil {
+			c.optional = make(map[string]bool)
+		}
+
+		c.optional[name] = true
+	}
+
+	if c.clock == nil {
+		c.clock = pq.clock
+	}
+
+	if c.collation == nil {
+		c.collation = pq.collation
+	} else if pq.collation != nil && *c.collation != *pq.collation {
+		return errors.New("queries have different collations")
+	}
+
+	return nil
+}
+
+func emptyNode(n *Node) bool {
+	return n.L == nil && n.R == nil && n.LN == nil && n.RN == nil
+}
+
+// cloneNode returns deep copy of tree, expressions are copied
+// because linking and reducing modify them.
+func cloneNode(n *Node) *Node {
+	if n == nil {
+		return nil
+	}
+
+	c := *n
+	c.L = cloneExpression(n.L)
+	c.R = cloneExpression(n.R)
+	c.LN = cloneNode(n.LN)
+	c.RN = cloneNode(n.RN)
+
+	return &c
+}
+
+func cloneExpression(e *Expression) *Expression {
+	if e == nil {
+		return nil
+	}
+
+	c := *e
+
+	if c.RT == VTNode {
+		c.RN = cloneNode(e.RN)
+		c.RN.FixParent()
+	}
+
+	if e.Links != nil {
+		links := make([]*Expression, len(*e.Links))
+		for i, le := range *e.Links {
+			links[i] = cloneExpression(le)
+		}
+
+		c.Links = &links
+	}
+
+	return &c
 }
 
 func encodeQuery(wc writeContext, node *Node, prmMap map[string]interface{}) error {
@@ -124,35 +463,15 @@ type writeContext struct {
 	dw bsonrw.DocumentWriter
 	aw bsonrw.ArrayWriter
 	vw bsonrw.ValueWriter
+	// now is a time of NOW() in query.
+	now time.Time
+	// ignoreCase is true if collation of query compares strings
+	// ignoring case, so `=~` is written as equality.
+	ignoreCase bool
 }
 
 type docFunc func(wc writeContext) (writeContext, error)
 
-func doc(node, parent *Node, wc writeContext) (docFunc, docFunc, docFunc) {
-	pop := "and"
-	if parent != nil {
-		pop = parent.Op
-	}
-
-	if node.Op == "or" {
-		if node.Op == pop {
-			// }, {
-			return emptyDoc, elemSep, emptyDoc
-		}
-
-		// $or: [ {
-		// }, {
-		// } ]
-		return clauseStart("$or"), elemSep, clauseEnd
-	}
-
-	return emptyDoc, emptyDoc, emptyDoc
-}
-
-func emptyDoc(wc writeContext) (writeContext, error) {
-	return wc, nil
-}
-
 func elemSep(wc writeContext) (writeContext, error) {
 	// }, {
 	err := wc.dw.WriteDocumentEnd()
@@ -220,6 +539,10 @@ func encodeExpressionList(
 	exp *Expression,
 	prmMap map[string]interface{},
 ) error {
+	if mergeable(exp) {
+		return encodeMergedExpressions(wc, exp, prmMap)
+	}
+
 	openDoc, sep, closeDoc := clauseStart("$and"), elemSep, clauseEnd
 
 	wc, err := openDoc(wc)
@@ -255,140 +578,1564 @@ func encodeExpressionList(
 	return err
 }
 
-func writeNodeDocument(
+// mergeable reports whether linked expressions can be written as
+// single field document with different operators (`k: { $gte: 1, $lt: 5 }`).
+func mergeable(exp *Expression) bool {
+	ops := map[string]bool{}
+
+	for _, e := range append([]*Expression{exp}, *exp.Links...) {
+		if e.Aggregation() {
+			return false
+		}
+
+		k, _, vt, op, err := expressionKeyValue(e)
+		if err != nil ||
+			vt == VTNode ||
+			vt == VTGeo ||
+			vt == VTText ||
+			vt == VTCalendar ||
+			vt == VTJSON ||
+			op == "=" ||
+			likeOp(op) ||
+			!bytes.Equal(k, exp.FindKey()) {
+			return false
+		}
+
+		ok := string(opKey(op))
+		if ops[ok] {
+			return false
+		}
+
+		ops[ok] = true
+	}
+
+	return true
+}
+
+func encodeMergedExpressions(
 	wc writeContext,
-	node *Node,
+	exp *Expression,
 	prmMap map[string]interface{},
 ) error {
-	openDoc, sep, closeDoc := doc(node, node.Parent, wc)
+	vw, err := wc.dw.WriteDocumentElement(string(exp.FindKey()))
+	if err != nil {
+		return err
+	}
 
-	wc, err := openDoc(wc)
+	wc.dw, err = vw.WriteDocument()
 	if err != nil {
 		return err
 	}
 
-	if node.LN != nil {
-		err := writeNodeDocument(wc, node.LN, prmMap)
+	for _, e := range append([]*Expression{exp}, *exp.Links...) {
+		e, err := resolveTime(wc, e, prmMap)
 		if err != nil {
 			return err
 		}
-	}
-
-	if node.L != nil {
-		if node.L.Links != nil {
-			err := encodeExpressionList(wc, node.L, prmMap)
-			if err != nil {
-				return err
-			}
-		} else {
-			err := encodeExpression(wc, node.L, prmMap)
-			if err != nil {
-				return err
-			}
-		}
-	}
 
-	if node.RN != nil || node.R != nil {
-		wc, err = sep(wc)
+		_, v, vt, op, err := expressionKeyValue(e)
 		if err != nil {
 			return err
 		}
-	}
 
-	if node.RN != nil {
-		err := writeNodeDocument(wc, node.RN, prmMap)
+		err = encodeElement(wc, opKey(op), v, vt, "=", prmMap)
 		if err != nil {
 			return err
 		}
 	}
 
-	if node.R != nil {
-		if node.R.Links != nil {
-			err := encodeExpressionList(wc, node.R, prmMap)
-			if err != nil {
-				return err
-			}
-		} else {
-			err := encodeExpression(wc, node.R, prmMap)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	_, err = closeDoc(wc)
-	return err
+	return wc.dw.WriteDocumentEnd()
 }
 
-func encodeExpression(
+func writeNodeDocument(
 	wc writeContext,
-	e *Expression,
+	node *Node,
 	prmMap map[string]interface{},
 ) error {
-	var k, v []byte
+	switch node.Op {
+	case "not":
+		return writeNotDocument(wc, node, prmMap)
+	case "or":
+		return writeOrDocument(wc, node, "$or", prmMap)
+	}
+
+	return writeAndDocument(wc, node, prmMap)
+}
+
+// operand is an operand of logical node, expression or nested node.
+type operand struct {
+	e *Expression
+	n *Node
+}
+
+// nodeOperands returns operands of node, operands of nested nodes
+// with the same logical operator are gathered as well.
+func nodeOperands(node *Node, ops []operand) []operand {
+	for _, side := range []struct {
+		n *Node
+		e *Expression
+	}{{node.LN, node.L}, {node.RN, node.R}} {
+		if side.n != nil {
+			if side.n.Op == node.Op || (node.Op != "or" && side.n.Op != "or" && side.n.Op != "not") {
+				ops = nodeOperands(side.n, ops)
+			} else {
+				ops = append(ops, operand{n: side.n})
+			}
+		}
+
+		if side.e != nil {
+			ops = append(ops, operand{e: side.e})
+		}
+	}
+
+	return ops
+}
 
-	if e.LT == VTKey {
-		k = e.L
+// empty reports whether operand matches any document,
+// like remainder of removed optional clause.
+func (o operand) empty() bool {
+	if o.e != nil {
+		return false
 	}
 
-	if e.RT == VTKey {
-		k = e.R
+	if o.n.Op == "or" || o.n.Op == "not" {
+		return len(nodeOperands(o.n, nil)) == 0
 	}
 
-	if len(k) == 0 {
-		return fmt.Errorf("no key for expression")
+	for _, no := range nodeOperands(o.n, nil) {
+		if !no.empty() {
+			return false
+		}
 	}
 
-	var vt ValueType
+	return true
+}
 
-	if e.LT != VTKey {
-		v = e.L
-		vt = e.LT
+func writeOperand(wc writeContext, o operand, prmMap map[string]interface{}) error {
+	if o.n != nil {
+		return writeNodeDocument(wc, o.n, prmMap)
 	}
 
-	if e.RT != VTKey {
-		v = e.R
-		vt = e.RT
+	if o.e.Links != nil {
+		return encodeExpressionList(wc, o.e, prmMap)
 	}
 
-	return encodeElement(wc, k, v, vt, e.Op, prmMap)
+	return encodeExpression(wc, o.e, prmMap)
 }
 
-// encodeElement writes document field with key k and value v.
-// It either writes simple form `k: v` (for = operation) or
-// complex form `k: { $op: v }` otherwise.
-func encodeElement(
+// writeAndDocument writes operands of "and" node into the same document.
+// If operands write the same field (like `a = 5 and not a = 6`)
+// or operator (like two $or) they are written as `$and: [ {...}, {...} ]`.
+func writeAndDocument(
 	wc writeContext,
-	k, v []byte,
-	vt ValueType,
-	op string,
+	node *Node,
 	prmMap map[string]interface{},
 ) error {
-	vw, err := wc.dw.WriteDocumentElement(string(k))
+	ops := nodeOperands(node, nil)
+	if len(ops) == 1 {
+		return writeOperand(wc, ops[0], prmMap)
+	}
+
+	if _, collision := operandsKeys(ops); !collision {
+		for _, o := range ops {
+			err := writeOperand(wc, o, prmMap)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	wc, err := clauseStart("$and")(wc)
 	if err != nil {
 		return err
 	}
 
-	if op == "=" {
-		return encodeValue(wc, v, vt, prmMap)
-	} else {
-		wc.dw, err = vw.WriteDocument()
-		if err != nil {
-			return err
+	first := true
+
+	for _, o := range ops {
+		if o.empty() {
+			continue
 		}
 
-		k = opKey(op)
+		if !first {
+			wc, err = elemSep(wc)
+			if err != nil {
+				return err
+			}
+		}
 
-		err = encodeElement(wc, k, v, vt, "=", prmMap)
+		first = false
+
+		err = writeOperand(wc, o, prmMap)
 		if err != nil {
 			return err
 		}
+	}
 
-		return wc.dw.WriteDocumentEnd()
+	_, err = clauseEnd(wc)
+	return err
+}
+
+// operandsKeys returns top level keys written by operands of "and" node
+// and reports whether some key is written twice.
+func operandsKeys(ops []operand) ([]string, bool) {
+	var keys []string
+
+	collision := false
+	seen := map[string]bool{}
+
+	for _, o := range ops {
+		for _, k := range o.keys() {
+			collision = collision || seen[k]
+			seen[k] = true
+			keys = append(keys, k)
+		}
 	}
+
+	return keys, collision
 }
 
-func opKey(op string) []byte {
+// keys returns top level keys of document written by operand.
+func (o operand) keys() []string {
+	if o.e != nil {
+		return expressionKeys(o.e, false)
+	}
+
+	switch o.n.Op {
+	case "or":
+		var ops []operand
+
+		for _, no := range nodeOperands(o.n, nil) {
+			if !no.empty() {
+				ops = append(ops, no)
+			}
+		}
+
+		switch len(ops) {
+		case 0:
+			return nil
+		case 1:
+			return ops[0].keys()
+		}
+
+		return []string{"$or"}
+	case "not":
+		n := o.n
+
+		switch {
+		case n.LN != nil && n.LN.Op == "or" && n.LN.Parent == n:
+			if (operand{n: n.LN}).empty() {
+				return nil
+			}
+
+			return []string{"$nor"}
+		case n.LN != nil:
+			return []string{"$nor"}
+		case n.L == nil:
+			return nil
+		case n.L.Links != nil:
+			return []string{"$nor"}
+		}
+
+		return expressionKeys(n.L, true)
+	}
+
+	keys, collision := operandsKeys(nodeOperands(o.n, nil))
+	if collision {
+		return []string{"$and"}
+	}
+
+	return keys
+}
+
+// expressionKeys returns top level keys written by expression
+// (or negated expression).
+func expressionKeys(e *Expression, negate bool) []string {
+	switch {
+	case e.Links != nil && !negate && !mergeable(e):
+		return []string{"$and"}
+	case e.Aggregation():
+		return []string{string(keyExpr)}
+	case e.RT == VTJSON && e.L == nil && negate:
+		return []string{"$nor"}
+	case e.RT == VTJSON && e.L == nil:
+		keys := make([]string, len(e.JSON))
+		for i, el := range e.JSON {
+			keys[i] = el.Key
+		}
+
+		return keys
+	}
+
+	return []string{string(e.FindKey())}
+}
+
+// writeOrDocument writes operands of "or" node as clause
+// ($or or $nor) array, empty operands are skipped. Single operand
+// of $or is written as is.
+func writeOrDocument(
+	wc writeContext,
+	node *Node,
+	clause string,
+	prmMap map[string]interface{},
+) error {
+	var ops []operand
+
+	for _, o := range nodeOperands(node, nil) {
+		if !o.empty() {
+			ops = append(ops, o)
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if len(ops) == 1 && clause == "$or" {
+		return writeOperand(wc, ops[0], prmMap)
+	}
+
+	wc, err := clauseStart(clause)(wc)
+	if err != nil {
+		return err
+	}
+
+	for i, o := range ops {
+		if i > 0 {
+			wc, err = elemSep(wc)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = writeOperand(wc, o, prmMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = clauseEnd(wc)
+	return err
+}
+
+// writeNotDocument writes negation of node's operand. Negation is pushed
+// down to the field operators where it is possible, otherwise
+// operand is wrapped with $nor.
+func writeNotDocument(
+	wc writeContext,
+	node *Node,
+	prmMap map[string]interface{},
+) error {
+	if node.LN != nil {
+		if node.LN.Op == "or" && node.LN.Parent == node {
+			return writeOrDocument(wc, node.LN, "$nor", prmMap)
+		}
+
+		wc, err := clauseStart("$nor")(wc)
+		if err != nil {
+			return err
+		}
+
+		err = writeNodeDocument(wc, node.LN, prmMap)
+		if err != nil {
+			return err
+		}
+
+		_, err = clauseEnd(wc)
+		return err
+	}
+
+	if node.L == nil {
+		return nil
+	}
+
+	if node.L.Links != nil {
+		wc, err := clauseStart("$nor")(wc)
+		if err != nil {
+			return err
+		}
+
+		err = encodeExpressionList(wc, node.L, prmMap)
+		if err != nil {
+			return err
+		}
+
+		_, err = clauseEnd(wc)
+		return err
+	}
+
+	return encodeNegatedExpression(wc, node.L, prmMap)
+}
+
+func encodeExpression(
+	wc writeContext,
+	e *Expression,
+	prmMap map[string]interface{},
+) error {
+	if e.Aggregation() {
+		return encodeAggregation(wc, e, false, prmMap)
+	}
+
+	if e.RT == VTJSON {
+		return encodeJSON(wc, e, false, prmMap)
+	}
+
+	e, err := resolveTime(wc, e, prmMap)
+	if err != nil {
+		return err
+	}
+
+	k, v, vt, op, err := expressionKeyValue(e)
+	if err != nil {
+		return err
+	}
+
+	if vt == VTNode {
+		return encodeQuantifier(wc, k, e, false, prmMap)
+	}
+
+	if vt == VTGeo {
+		return encodeGeo(wc, k, e, false, prmMap)
+	}
+
+	if vt == VTCalendar {
+		return encodeCalendar(wc, k, e, false, prmMap)
+	}
+
+	if vt == VTText {
+		return encodeText(wc, e.Text, prmMap)
+	}
+
+	if op == "=~" && wc.ignoreCase {
+		op = "="
+	}
+
+	if likeOp(op) {
+		v, vt, op, err = likeRegex(op, v, vt, prmMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	return encodeElement(wc, k, v, vt, op, prmMap)
+}
+
+// encodeQuantifier writes array quantifier block.
+// ANY is written as `k: { $elemMatch: { ... } }`,
+// NONE as `k: { $not: { $elemMatch: { ... } } }` and
+// ALL as `k: { $not: { $elemMatch: { $nor: [ { ... } ] } } }`.
+func encodeQuantifier(
+	wc writeContext,
+	k []byte,
+	e *Expression,
+	negate bool,
+	prmMap map[string]interface{},
+) error {
+	not := (e.Op == "none" || e.Op == "all") != negate
+	nor := e.Op == "all"
+
+	vw, err := wc.dw.WriteDocumentElement(string(k))
+	if err != nil {
+		return err
+	}
+
+	wc.dw, err = vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	if not {
+		vw, err = wc.dw.WriteDocumentElement("$not")
+		if err != nil {
+			return err
+		}
+
+		wc.dw, err = vw.WriteDocument()
+		if err != nil {
+			return err
+		}
+	}
+
+	vw, err = wc.dw.WriteDocumentElement("$elemMatch")
+	if err != nil {
+		return err
+	}
+
+	wc.vw = vw
+	if nor {
+		err = encodeQuery(wc, &Node{Op: "not", LN: e.RN}, prmMap)
+	} else {
+		err = encodeQuery(wc, e.RN, prmMap)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if not {
+		err = wc.dw.WriteDocumentEnd()
+		if err != nil {
+			return err
+		}
+	}
+
+	return wc.dw.WriteDocumentEnd()
+}
+
+// encodeNegatedExpression writes inverted operator (`k: { $ne: v }`)
+// if there is one, or `k: { $not: { $op: v } }` otherwise.
+func encodeNegatedExpression(
+	wc writeContext,
+	e *Expression,
+	prmMap map[string]interface{},
+) error {
+	if e.Aggregation() {
+		return encodeAggregation(wc, e, true, prmMap)
+	}
+
+	if e.RT == VTJSON {
+		return encodeJSON(wc, e, true, prmMap)
+	}
+
+	e, err := resolveTime(wc, e, prmMap)
+	if err != nil {
+		return err
+	}
+
+	k, v, vt, op, err := expressionKeyValue(e)
+	if err != nil {
+		return err
+	}
+
+	if vt == VTNode {
+		return encodeQuantifier(wc, k, e, true, prmMap)
+	}
+
+	if vt == VTGeo {
+		return encodeGeo(wc, k, e, true, prmMap)
+	}
+
+	if vt == VTCalendar {
+		return encodeCalendar(wc, k, e, true, prmMap)
+	}
+
+	if vt == VTText {
+		return errors.New("TEXT can not be negated")
+	}
+
+	if op == "=~" && wc.ignoreCase {
+		op = "="
+	}
+
+	if likeOp(op) {
+		v, vt, op, err = likeRegex(op, v, vt, prmMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	if vt != VTRegex {
+		if nop, ok := negatedOp(op); ok {
+			return encodeElement(wc, k, v, vt, nop, prmMap)
+		}
+
+		if op == "$exists" && vt == VTBool {
+			return encodeElement(wc, k, []byte{1 - v[0]}, vt, op, prmMap)
+		}
+	}
+
+	if op == "=" && vt != VTRegex {
+		op = "$eq"
+	}
+
+	vw, err := wc.dw.WriteDocumentElement(string(k))
+	if err != nil {
+		return err
+	}
+
+	wc.dw, err = vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	err = encodeElement(wc, []byte("$not"), v, vt, op, prmMap)
+	if err != nil {
+		return err
+	}
+
+	return wc.dw.WriteDocumentEnd()
+}
+
+// encodeText writes full-text search clause
+// `$text: { $search: "...", $language: "en", $caseSensitive: true }`.
+func encodeText(wc writeContext, text *Text, prmMap map[string]interface{}) error {
+	vw, err := wc.dw.WriteDocumentElement(string(keyText))
+	if err != nil {
+		return err
+	}
+
+	wc.dw, err = vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	err = encodeElement(wc, []byte("$search"), text.Search, text.SearchT, "=", prmMap)
+	if err != nil {
+		return err
+	}
+
+	if text.Language != nil {
+		err = encodeElement(wc, []byte("$language"), text.Language, text.LanguageT, "=", prmMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	if text.CaseSensitive {
+		err = encodeElement(wc, []byte("$caseSensitive"), []byte{1}, VTBool, "=", prmMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	if text.DiacriticSensitive {
+		err = encodeElement(wc, []byte("$diacriticSensitive"), []byte{1}, VTBool, "=", prmMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	return wc.dw.WriteDocumentEnd()
+}
+
+// encodeJSON writes extended JSON fragment with bound parameters.
+// Fragment without field is spliced into query (negated one is
+// written as `$nor: [ {...} ]`), otherwise it is written as
+// `k: {...}` or `k: { $not: {...} }`.
+func encodeJSON(wc writeContext, e *Expression, negate bool, prmMap map[string]interface{}) error {
+	doc := bindParams(e.JSON, prmMap).(bson.D)
+
+	var err error
+
+	switch {
+	case e.L != nil && negate:
+		wc.vw, err = wc.dw.WriteDocumentElement(string(e.L))
+		if err != nil {
+			return err
+		}
+
+		return encodeParam(wc, bson.D{{Key: "$not", Value: doc}})
+	case e.L != nil:
+		wc.vw, err = wc.dw.WriteDocumentElement(string(e.L))
+		if err != nil {
+			return err
+		}
+
+		return encodeParam(wc, doc)
+	case negate:
+		wc.vw, err = wc.dw.WriteDocumentElement("$nor")
+		if err != nil {
+			return err
+		}
+
+		return encodeParam(wc, bson.A{doc})
+	}
+
+	for _, el := range doc {
+		wc.vw, err = wc.dw.WriteDocumentElement(el.Key)
+		if err != nil {
+			return err
+		}
+
+		err = encodeParam(wc, el.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bindParams returns copy of JSON value where string placeholders
+// (like "$name") are replaced with parameters, strings without
+// parameter are left as is (same as mgx.ParseQuery).
+func bindParams(v interface{}, prmMap map[string]interface{}) interface{} {
+	switch tv := v.(type) {
+	case bson.D:
+		c := make(bson.D, len(tv))
+		for i, e := range tv {
+			c[i] = bson.E{Key: e.Key, Value: bindParams(e.Value, prmMap)}
+		}
+
+		return c
+	case bson.A:
+		c := make(bson.A, len(tv))
+		for i, e := range tv {
+			c[i] = bindParams(e, prmMap)
+		}
+
+		return c
+	case string:
+		if strings.HasPrefix(tv, "$") {
+			if pv, ok := prmMap[tv]; ok {
+				return pv
+			}
+		}
+	}
+
+	return v
+}
+
+// resolveTime evaluates date arithmetic operand of expression,
+// copy of expression with date (or duration) value is returned.
+func resolveTime(wc writeContext, e *Expression, prmMap map[string]interface{}) (*Expression, error) {
+	if e.LT != VTTimeCalc && e.RT != VTTimeCalc {
+		return e, nil
+	}
+
+	re := *e
+
+	var err error
+
+	if re.LT == VTTimeCalc {
+		re.L, re.LT, err = timeCalcValue(wc, re.LC, prmMap)
+		re.LC = nil
+	}
+
+	if err == nil && re.RT == VTTimeCalc {
+		re.R, re.RT, err = timeCalcValue(wc, re.RC, prmMap)
+		re.RC = nil
+	}
+
+	return &re, err
+}
+
+// timeCalcValue evaluates date arithmetic and returns
+// date (VTDate) or duration (VTDuration) value.
+func timeCalcValue(wc writeContext, c *Calc, prmMap map[string]interface{}) ([]byte, ValueType, error) {
+	tv, err := evalTime(wc, c, prmMap)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if tv.date {
+		return binary.BigEndian.AppendUint64(nil, uint64(tv.t.UnixMilli())), VTDate, nil
+	}
+
+	return binary.BigEndian.AppendUint64(nil, uint64(tv.d)), VTDuration, nil
+}
+
+// timeValue is a date or duration.
+type timeValue struct {
+	date bool
+	t    time.Time
+	d    time.Duration
+}
+
+func evalTime(wc writeContext, c *Calc, prmMap map[string]interface{}) (timeValue, error) {
+	switch c.Op {
+	case "":
+		return timeLeafValue(c, prmMap)
+	case "now", "NOW":
+		return timeValue{date: true, t: wc.now}, nil
+	case "+", "-":
+	default:
+		return timeValue{}, fmt.Errorf("operator %s can not be used in date arithmetic", c.Op)
+	}
+
+	r, err := evalTime(wc, c.Args[0], prmMap)
+	if err != nil {
+		return r, err
+	}
+
+	for _, a := range c.Args[1:] {
+		av, err := evalTime(wc, a, prmMap)
+		if err != nil {
+			return r, err
+		}
+
+		switch {
+		case c.Op == "+" && r.date && av.date:
+			return r, errors.New("dates can not be added")
+		case c.Op == "+" && r.date:
+			r.t = r.t.Add(av.d)
+		case c.Op == "+" && av.date:
+			r = timeValue{date: true, t: av.t.Add(r.d)}
+		case c.Op == "+":
+			r.d += av.d
+		case r.date && av.date:
+			r = timeValue{d: r.t.Sub(av.t)}
+		case r.date:
+			r.t = r.t.Add(-av.d)
+		case av.date:
+			return r, errors.New("date can not be subtracted from duration")
+		default:
+			r.d -= av.d
+		}
+	}
+
+	return r, nil
+}
+
+func timeLeafValue(c *Calc, prmMap map[string]interface{}) (timeValue, error) {
+	switch c.VT {
+	case VTDate:
+		ms := int64(binary.BigEndian.Uint64(c.V))
+		return timeValue{date: true, t: time.UnixMilli(ms)}, nil
+	case VTDuration:
+		return timeValue{d: time.Duration(binary.BigEndian.Uint64(c.V))}, nil
+	case VTParam, VTString:
+		name := string(c.V)
+		if c.VT == VTString {
+			name = name[1 : len(name)-1]
+		}
+
+		pv, ok := prmMap[name]
+		if !ok {
+			return timeValue{}, fmt.Errorf("parameter %s is not set", name)
+		}
+
+		switch tv := pv.(type) {
+		case time.Time:
+			return timeValue{date: true, t: tv}, nil
+		case *time.Time:
+			if tv != nil {
+				return timeValue{date: true, t: *tv}, nil
+			}
+		case primitive.DateTime:
+			return timeValue{date: true, t: tv.Time()}, nil
+		case time.Duration:
+			return timeValue{d: tv}, nil
+		}
+
+		return timeValue{}, fmt.Errorf("parameter %s must be date or duration, got %T", name, pv)
+	}
+
+	return timeValue{}, fmt.Errorf("value %s can not be used in date arithmetic", c)
+}
+
+// encodeCalendar writes calendar period as half-open range
+// `k: { $gte: start, $lt: end }` or `k: { $not: { ... } }`.
+func encodeCalendar(
+	wc writeContext,
+	k []byte,
+	e *Expression,
+	negate bool,
+	prmMap map[string]interface{},
+) error {
+	start, end, err := calendarRange(wc, e.Cal, prmMap)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{} = bson.D{
+		{Key: "$gte", Value: primitive.NewDateTimeFromTime(start)},
+		{Key: "$lt", Value: primitive.NewDateTimeFromTime(end)},
+	}
+
+	if e.Op == "!=" || e.Op == "<>" || e.Op == "$nin" {
+		negate = !negate
+	}
+
+	if negate {
+		doc = bson.D{{Key: "$not", Value: doc}}
+	}
+
+	wc.vw, err = wc.dw.WriteDocumentElement(string(k))
+	if err != nil {
+		return err
+	}
+
+	return encodeParam(wc, doc)
+}
+
+// calendarRange returns start and end of calendar period. Weeks start on Monday.
+func calendarRange(wc writeContext, cal *Calendar, prmMap map[string]interface{}) (time.Time, time.Time, error) {
+	loc := cal.Loc
+
+	if cal.ZoneParam != "" {
+		pv, ok := prmMap[cal.ZoneParam]
+		if !ok {
+			return time.Time{}, time.Time{}, fmt.Errorf("parameter %s is not set", cal.ZoneParam)
+		}
+
+		switch tv := pv.(type) {
+		case *time.Location:
+			loc = tv
+		case string:
+			var err error
+
+			loc, err = time.LoadLocation(tv)
+			if err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("unknown time zone %s", tv)
+			}
+		default:
+			return time.Time{}, time.Time{}, fmt.Errorf("parameter %s must be time zone, got %T", cal.ZoneParam, pv)
+		}
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	t := wc.now
+
+	switch cal.DateT {
+	case VTDate:
+		t = time.UnixMilli(int64(binary.BigEndian.Uint64(cal.Date)))
+	case VTString:
+		ds := string(cal.Date[1 : len(cal.Date)-1])
+
+		var err error
+
+		t, err = parseDate(ds, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date %s", ds)
+		}
+	case VTParam:
+		pv, ok := prmMap[string(cal.Date)]
+		if !ok {
+			return time.Time{}, time.Time{}, fmt.Errorf("parameter %s is not set", cal.Date)
+		}
+
+		switch tv := pv.(type) {
+		case time.Time:
+			t = tv
+		case *time.Time:
+			if tv == nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("parameter %s is nil", cal.Date)
+			}
+
+			t = *tv
+		case primitive.DateTime:
+			t = tv.Time()
+		case string:
+			var err error
+
+			t, err = parseDate(tv, loc)
+			if err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("parameter %s is invalid date %s", cal.Date, tv)
+			}
+		default:
+			return time.Time{}, time.Time{}, fmt.Errorf("parameter %s must be date, got %T", cal.Date, pv)
+		}
+	}
+
+	y, m, d := t.In(loc).Date()
+
+	switch cal.Unit {
+	case "WEEK":
+		wd := (int(t.In(loc).Weekday()) + 6) % 7
+		start := time.Date(y, m, d-wd, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 7), nil
+	case "MONTH":
+		start := time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0), nil
+	case "YEAR":
+		start := time.Date(y, 1, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(1, 0, 0), nil
+	}
+
+	start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1), nil
+}
+
+// earthRadius is equatorial radius of the Earth in meters
+// used to convert circle radius to radians.
+const earthRadius = 6378100
+
+// encodeGeo writes geospatial predicate like
+// `k: { $near: { $geometry: { type: "Point", coordinates: [1, 2] }, $maxDistance: 5 } }`
+// or `k: { $geoWithin: { $centerSphere: [ [1, 2], 0.1 ] } }` for circle.
+func encodeGeo(
+	wc writeContext,
+	k []byte,
+	e *Expression,
+	negate bool,
+	prmMap map[string]interface{},
+) error {
+	g := e.G
+
+	var opDoc bson.D
+
+	if g.Type == "Circle" {
+		center := bson.A{g.Coords[0][0], g.Coords[0][1]}
+		opDoc = bson.D{{Key: "$centerSphere", Value: bson.A{center, g.Radius / earthRadius}}}
+	} else {
+		geometry, err := geoGeometry(g, prmMap)
+		if err != nil {
+			return err
+		}
+
+		opDoc = bson.D{{Key: "$geometry", Value: geometry}}
+	}
+
+	if g.Dist != nil {
+		var dist interface{}
+
+		switch g.DistT {
+		case VTFloat:
+			dist = math.Float64frombits(binary.BigEndian.Uint64(g.Dist))
+		case VTParam:
+			var ok bool
+			dist, ok = prmMap[string(g.Dist)]
+			if !ok {
+				return fmt.Errorf("parameter %s is not set", g.Dist)
+			}
+		}
+
+		opDoc = append(opDoc, bson.E{Key: "$maxDistance", Value: dist})
+	}
+
+	doc := bson.D{{Key: e.Op, Value: opDoc}}
+
+	if negate {
+		if e.Op == "$near" || e.Op == "$nearSphere" {
+			return fmt.Errorf("%s can not be negated", e.Op)
+		}
+
+		doc = bson.D{{Key: "$not", Value: doc}}
+	}
+
+	var err error
+
+	wc.vw, err = wc.dw.WriteDocumentElement(string(k))
+	if err != nil {
+		return err
+	}
+
+	return encodeParam(wc, doc)
+}
+
+// geoJSONTyper is implemented by geometries of
+// github.com/paulmach/orb and similar packages.
+type geoJSONTyper interface {
+	GeoJSONType() string
+}
+
+// geoPoint reports whether v is a point like orb.Point.
+func geoPoint(v reflect.Value) bool {
+	return v.IsValid() &&
+		(v.Kind() == reflect.Array || v.Kind() == reflect.Slice) &&
+		v.Len() == 2 &&
+		v.Type().Elem().Kind() == reflect.Float64
+}
+
+// geoGeometry returns GeoJSON document of geometry.
+// Parameter can be GeoJSON document (map, struct, bson.D), point as
+// [2]float64 or []float64, or geometry with GeoJSONType method
+// (like orb.Point, orb.Polygon or orb.Bound). Struct with GeoJSONType
+// method other than bound is written as is.
+func geoGeometry(g *Geo, prmMap map[string]interface{}) (interface{}, error) {
+	if g.Param == "" {
+		if g.Type == "Point" {
+			return bson.D{
+				{Key: "type", Value: g.Type},
+				{Key: "coordinates", Value: g.Coords[0]},
+			}, nil
+		}
+
+		return bson.D{
+			{Key: "type", Value: g.Type},
+			{Key: "coordinates", Value: [][][2]float64{g.Coords}},
+		}, nil
+	}
+
+	pv, ok := prmMap[g.Param]
+	if !ok {
+		return nil, fmt.Errorf("parameter %s is not set", g.Param)
+	}
+
+	if pv == nil {
+		return nil, fmt.Errorf("parameter %s must be geometry, got nil", g.Param)
+	}
+
+	rv := reflect.ValueOf(pv)
+
+	if gt, ok := pv.(geoJSONTyper); ok {
+		if rv.Kind() == reflect.Struct {
+			// bound with Min and Max points
+			min, max := rv.FieldByName("Min"), rv.FieldByName("Max")
+			if !geoPoint(min) || !geoPoint(max) {
+				// other GeoJSON value is marshaled by driver
+				return pv, nil
+			}
+
+			return geoGeometry(&Geo{
+				Type: "Polygon",
+				Coords: [][2]float64{
+					{min.Index(0).Float(), min.Index(1).Float()},
+					{max.Index(0).Float(), min.Index(1).Float()},
+					{max.Index(0).Float(), max.Index(1).Float()},
+					{min.Index(0).Float(), max.Index(1).Float()},
+					{min.Index(0).Float(), min.Index(1).Float()},
+				},
+			}, prmMap)
+		}
+
+		return bson.D{
+			{Key: "type", Value: gt.GeoJSONType()},
+			{Key: "coordinates", Value: pv},
+		}, nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Array, reflect.Slice:
+		if rv.Len() == 2 && rv.Type().Elem().Kind() == reflect.Float64 {
+			return bson.D{
+				{Key: "type", Value: "Point"},
+				{Key: "coordinates", Value: pv},
+			}, nil
+		}
+
+		if _, isDoc := pv.(bson.D); isDoc {
+			return pv, nil
+		}
+	case reflect.Map, reflect.Struct, reflect.Ptr:
+		return pv, nil
+	}
+
+	return nil, fmt.Errorf("parameter %s must be geometry, got %T", g.Param, pv)
+}
+
+func negatedOp(op string) (string, bool) {
+	switch op {
+	case "=", "$eq":
+		return "!=", true
+	case "!=", "<>", "$ne":
+		return "=", true
+	case "$in":
+		return "$nin", true
+	case "$nin":
+		return "$in", true
+	}
+
+	return "", false
+}
+
+// expressionKeyValue returns key, value and operator of expression,
+// parser puts key on the left side (see normalizeOperands).
+func expressionKeyValue(e *Expression) ([]byte, []byte, ValueType, string, error) {
+	if e.LT != VTKey || len(e.L) == 0 {
+		return nil, nil, 0, "", fmt.Errorf("no key for expression")
+	}
+
+	return e.L, e.R, e.RT, e.Op, nil
+}
+
+func likeOp(op string) bool {
+	switch op {
+	case "like", "ilike", "startswith", "endswith", "contains", "=~":
+		return true
+	}
+
+	return false
+}
+
+// likeRegex converts string predicate with pattern (string or parameter)
+// to regex value. All regex metacharacters of pattern are escaped.
+func likeRegex(
+	op string,
+	v []byte,
+	vt ValueType,
+	prmMap map[string]interface{},
+) ([]byte, ValueType, string, error) {
+	var s string
+
+	switch vt {
+	case VTString:
+		s = string(v[1 : len(v)-1])
+		if ok, lv := lookupValue(s, prmMap); ok {
+			ls, isString := lv.(string)
+			if !isString {
+				return nil, 0, "", fmt.Errorf("parameter %s for %s must be string", s, op)
+			}
+
+			s = ls
+		}
+	case VTParam:
+		lv, ok := prmMap[string(v)]
+		if !ok {
+			return nil, 0, "", fmt.Errorf("parameter %s is not set", v)
+		}
+
+		ls, isString := lv.(string)
+		if !isString {
+			return nil, 0, "", fmt.Errorf("parameter %s for %s must be string", v, op)
+		}
+
+		s = ls
+	default:
+		return nil, 0, "", fmt.Errorf("%s expects string", op)
+	}
+
+	var pattern, options string
+
+	switch op {
+	case "startswith":
+		pattern = "^" + regexp.QuoteMeta(s)
+	case "endswith":
+		pattern = regexp.QuoteMeta(s) + "$"
+	case "contains":
+		pattern = regexp.QuoteMeta(s)
+	case "=~":
+		pattern = "^" + regexp.QuoteMeta(s) + "$"
+		options = "i"
+	case "like", "ilike":
+		pattern = likePattern(s)
+		options = "s"
+		if op == "ilike" {
+			options = "is"
+		}
+	}
+
+	return []byte("/" + pattern + "/" + options), VTRegex, "=", nil
+}
+
+// likePattern converts SQL LIKE pattern (% - any sequence, _ - any symbol,
+// \ escapes next symbol) to anchored regex.
+func likePattern(s string) string {
+	var sb strings.Builder
+
+	sb.WriteByte('^')
+
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			sb.WriteString(".*")
+		case r == '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	if escaped {
+		sb.WriteString(regexp.QuoteMeta("\\"))
+	}
+
+	sb.WriteByte('$')
+	return sb.String()
+}
+
+// reversedOp returns operator for swapped operands.
+func reversedOp(op string) string {
+	switch op {
+	case "<":
+		return ">"
+	case ">":
+		return "<"
+	case "<=":
+		return ">="
+	case ">=":
+		return "<="
+	case "$lt":
+		return "$gt"
+	case "$gt":
+		return "$lt"
+	case "$lte":
+		return "$gte"
+	case "$gte":
+		return "$lte"
+	}
+
+	return op
+}
+
+// calcOps maps operations and functions of calculated operand
+// to aggregation operators.
+var calcOps = map[string]string{
+	"+":           "$add",
+	"-":           "$subtract",
+	"*":           "$multiply",
+	"/":           "$divide",
+	"%":           "$mod",
+	"abs":         "$abs",
+	"ceil":        "$ceil",
+	"floor":       "$floor",
+	"round":       "$round",
+	"trunc":       "$trunc",
+	"sqrt":        "$sqrt",
+	"pow":         "$pow",
+	"exp":         "$exp",
+	"ln":          "$ln",
+	"log10":       "$log10",
+	"min":         "$min",
+	"max":         "$max",
+	"avg":         "$avg",
+	"sum":         "$sum",
+	"size":        "$size",
+	"isArray":     "$isArray",
+	"arrayElemAt": "$arrayElemAt",
+	"ifNull":      "$ifNull",
+	"type":        "$type",
+	"strLen":      "$strLenCP",
+	"toLower":     "$toLower",
+	"toUpper":     "$toUpper",
+	"trim":        "$trim",
+	"concat":      "$concat",
+	"substr":      "$substrCP",
+	"indexOf":     "$indexOfCP",
+	"year":        "$year",
+	"month":       "$month",
+	"week":        "$week",
+	"dayOfMonth":  "$dayOfMonth",
+	"dayOfWeek":   "$dayOfWeek",
+	"dayOfYear":   "$dayOfYear",
+	"hour":        "$hour",
+	"minute":      "$minute",
+	"second":      "$second",
+}
+
+// encodeAggregation writes expression with calculated operands or
+// comparison of two fields as `$expr: { $op: [ l, r ] }`.
+func encodeAggregation(
+	wc writeContext,
+	e *Expression,
+	negate bool,
+	prmMap map[string]interface{},
+) error {
+	op, ok := aggregationOp(e.Op, negate)
+	if !ok {
+		return fmt.Errorf("operator %s can not be used in aggregation expression", e.Op)
+	}
+
+	vw, err := wc.dw.WriteDocumentElement("$expr")
+	if err != nil {
+		return err
+	}
+
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	wc.dw = dw
+
+	c := &Calc{
+		Op: op,
+		Args: []*Calc{
+			expressionCalc(e.L, e.LT, e.LC),
+			expressionCalc(e.R, e.RT, e.RC),
+		},
+	}
+
+	err = encodeCalcOperation(wc, op, c.Args, prmMap)
+	if err != nil {
+		return err
+	}
+
+	return dw.WriteDocumentEnd()
+}
+
+func expressionCalc(v []byte, vt ValueType, c *Calc) *Calc {
+	if vt == VTCalc || vt == VTTimeCalc {
+		return c
+	}
+
+	return &Calc{V: v, VT: vt}
+}
+
+// encodeCalc writes calculated operand as aggregation expression value.
+func encodeCalc(wc writeContext, c *Calc, prmMap map[string]interface{}) error {
+	if c.Op == "" {
+		return encodeCalcValue(wc, c.V, c.VT, prmMap)
+	}
+
+	if c.Op == "now" || c.Op == "NOW" || c.TimeCalc() {
+		v, vt, err := timeCalcValue(wc, c, prmMap)
+		if err != nil {
+			return err
+		}
+
+		return encodeValue(wc, v, vt, prmMap)
+	}
+
+	op, ok := calcOps[c.Op]
+	if !ok {
+		return fmt.Errorf("unknown function %s", c.Op)
+	}
+
+	dw, err := wc.vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	wc.dw = dw
+
+	err = encodeCalcOperation(wc, op, c.Args, prmMap)
+	if err != nil {
+		return err
+	}
+
+	return dw.WriteDocumentEnd()
+}
+
+// encodeCalcOperation writes `$op: [ args... ]` element.
+func encodeCalcOperation(wc writeContext, op string, args []*Calc, prmMap map[string]interface{}) error {
+	vw, err := wc.dw.WriteDocumentElement(op)
+	if err != nil {
+		return err
+	}
+
+	aw, err := vw.WriteArray()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range args {
+		wc.vw, err = aw.WriteArrayElement()
+		if err != nil {
+			return err
+		}
+
+		err = encodeCalc(wc, a, prmMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	return aw.WriteArrayEnd()
+}
+
+// encodeCalcValue writes single value of aggregation expression,
+// fields are written as "$field" and strings with $ prefix
+// are wrapped with $literal.
+func encodeCalcValue(wc writeContext, v []byte, vt ValueType, prmMap map[string]interface{}) error {
+	switch vt {
+	case VTKey:
+		return wc.vw.WriteString("$" + string(v))
+	case VTVar:
+		return wc.vw.WriteString(string(v))
+	case VTString:
+		sv := string(v[1 : len(v)-1])
+		ok, lv := lookupValue(sv, prmMap)
+		if ok {
+			return encodeCalcParam(wc, v, vt, lv, prmMap)
+		}
+
+		if strings.HasPrefix(sv, "$") {
+			return writeLiteral(wc, sv)
+		}
+	case VTParam:
+		lv, ok := prmMap[string(v)]
+		if ok {
+			return encodeCalcParam(wc, v, vt, lv, prmMap)
+		}
+	}
+
+	return encodeValue(wc, v, vt, prmMap)
+}
+
+// encodeCalcParam encodes parameter value lv of calculation operand,
+// string starting with $ is written as literal, so it is not
+// interpreted as field path.
+func encodeCalcParam(
+	wc writeContext,
+	v []byte,
+	vt ValueType,
+	lv interface{},
+	prmMap map[string]interface{},
+) error {
+	if s, isString := lv.(string); isString && strings.HasPrefix(s, "$") {
+		return writeLiteral(wc, s)
+	}
+
+	return encodeValue(wc, v, vt, prmMap)
+}
+
+func writeLiteral(wc writeContext, s string) error {
+	dw, err := wc.vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	vw, err := dw.WriteDocumentElement("$literal")
+	if err != nil {
+		return err
+	}
+
+	err = vw.WriteString(s)
+	if err != nil {
+		return err
+	}
+
+	return dw.WriteDocumentEnd()
+}
+
+// aggregationOp returns aggregation comparison operator (optionally inverted).
+func aggregationOp(op string, negate bool) (string, bool) {
+	ops := [][2]string{
+		{"$eq", "$ne"},
+		{"$gt", "$lte"},
+		{"$lt", "$gte"},
+	}
+
+	k := string(opKey(op))
+
+	for _, o := range ops {
+		switch k {
+		case o[0]:
+			if negate {
+				return o[1], true
+			}
+
+			return o[0], true
+		case o[1]:
+			if negate {
+				return o[0], true
+			}
+
+			return o[1], true
+		}
+	}
+
+	return "", false
+}
+
+// encodeElement writes document field with key k and value v.
+// It either writes simple form `k: v` (for = operation) or
+// complex form `k: { $op: v }` otherwise.
+func encodeElement(
+	wc writeContext,
+	k, v []byte,
+	vt ValueType,
+	op string,
+	prmMap map[string]interface{},
+) error {
+	vw, err := wc.dw.WriteDocumentElement(string(k))
+	if err != nil {
+		return err
+	}
+
+	if op == "=" {
+		return encodeValue(wc, v, vt, prmMap)
+	} else {
+		wc.dw, err = vw.WriteDocument()
+		if err != nil {
+			return err
+		}
+
+		k = opKey(op)
+
+		err = encodeElement(wc, k, v, vt, "=", prmMap)
+		if err != nil {
+			return err
+		}
+
+		return wc.dw.WriteDocumentEnd()
+	}
+}
+
+func opKey(op string) []byte {
 	switch op {
 	case ">":
 		return []byte("$gt")
@@ -418,27 +2165,63 @@ func encodeValue(
 		sv := string(v[1 : len(v)-1])
 		ok, lv := lookupValue(sv, prmMap)
 		if ok {
-			enc, err := wc.ec.LookupEncoder(reflect.TypeOf(lv))
-			if err != nil {
-				return err
-			}
-
-			return enc.EncodeValue(wc.ec, wc.vw, reflect.ValueOf(lv))
+			return encodeParam(wc, lv)
 		}
 
 		return wc.vw.WriteString(sv)
+	case VTParam:
+		lv, ok := prmMap[string(v)]
+		if !ok {
+			return fmt.Errorf("parameter %s is not set", v)
+		}
+
+		return encodeParam(wc, lv)
+	case VTArrayParam:
+		lv, ok := prmMap[string(v)]
+		if !ok {
+			return fmt.Errorf("parameter %s is not set", v)
+		}
+
+		return encodeArrayParam(wc, string(v), lv)
 	case VTInteger:
-		ui := binary.BigEndian.Uint64(v)
-		return wc.vw.WriteInt64(int64(ui))
+		// same as Go driver encodes int
+		i := int64(binary.BigEndian.Uint64(v))
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			return wc.vw.WriteInt32(int32(i))
+		}
+
+		return wc.vw.WriteInt64(i)
 	case VTFloat:
 		ui := binary.BigEndian.Uint64(v)
 		f := math.Float64frombits(ui)
 		return wc.vw.WriteDouble(f)
 	case VTKey:
-		if string(v) == "null" {
-			return wc.vw.WriteNull()
-		}
 		return wc.vw.WriteString(string(v))
+	case VTNull:
+		return wc.vw.WriteNull()
+	case VTDuration:
+		// durations are milliseconds like in date arithmetic of aggregation
+		d := time.Duration(binary.BigEndian.Uint64(v))
+		return wc.vw.WriteInt64(d.Milliseconds())
+	case VTVar:
+		return wc.vw.WriteString(string(v))
+	case VTDecimal:
+		d := primitive.NewDecimal128(binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:]))
+		return wc.vw.WriteDecimal128(d)
+	case VTInt32:
+		return wc.vw.WriteInt32(int32(binary.BigEndian.Uint32(v)))
+	case VTInt64:
+		return wc.vw.WriteInt64(int64(binary.BigEndian.Uint64(v)))
+	case VTUUID:
+		return wc.vw.WriteBinaryWithSubtype(v, bsontype.BinaryUUID)
+	case VTBinary:
+		return wc.vw.WriteBinaryWithSubtype(v[1:], v[0])
+	case VTTimestamp:
+		return wc.vw.WriteTimestamp(binary.BigEndian.Uint32(v), binary.BigEndian.Uint32(v[4:]))
+	case VTMinKey:
+		return wc.vw.WriteMinKey()
+	case VTMaxKey:
+		return wc.vw.WriteMaxKey()
 	case VTDate:
 		dt := binary.BigEndian.Uint64(v)
 		return wc.vw.WriteDateTime(int64(dt))
@@ -464,6 +2247,8 @@ func encodeValue(
 		return wc.vw.WriteRegex(p, o)
 	case VTArray:
 		return encodeArray(wc, v, prmMap)
+	case VTDocument:
+		return encodeDocument(wc, v, prmMap)
 	}
 
 	return nil
@@ -505,15 +2290,98 @@ func encodeArray(wc writeContext, arr []byte, prmMap map[string]interface{}) err
 	return wc.aw.WriteArrayEnd()
 }
 
+// encodeDocument writes embedded document literal.
+func encodeDocument(wc writeContext, doc []byte, prmMap map[string]interface{}) error {
+	dw, err := wc.vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	c := binary.BigEndian.Uint32(doc)
+	doc = doc[4:]
+
+	for i := uint32(0); i < c; i++ {
+		kl := binary.BigEndian.Uint32(doc)
+		k := doc[4 : 4+kl]
+		doc = doc[4+kl:]
+
+		vt := ValueType(doc[0])
+		doc = doc[1:]
+
+		var tl uint32
+		tl, doc = tokenLength(vt, doc)
+
+		wc.vw, err = dw.WriteDocumentElement(string(k))
+		if err != nil {
+			return err
+		}
+
+		err = encodeValue(wc, doc[:tl], vt, prmMap)
+		if err != nil {
+			return err
+		}
+
+		doc = doc[tl:]
+	}
+
+	return dw.WriteDocumentEnd()
+}
+
+func encodeParam(wc writeContext, pv interface{}) error {
+	if pv == nil {
+		return wc.vw.WriteNull()
+	}
+
+	enc, err := wc.ec.LookupEncoder(reflect.TypeOf(pv))
+	if err != nil {
+		return err
+	}
+
+	return enc.EncodeValue(wc.ec, wc.vw, reflect.ValueOf(pv))
+}
+
+// encodeArrayParam encodes parameter value which must be slice or array
+// (bson.A, []string, [3]int, ...), byte slices are not treated as arrays.
+func encodeArrayParam(wc writeContext, name string, pv interface{}) error {
+	rv := reflect.ValueOf(pv)
+
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+
+		if rv.IsNil() {
+			// nil slice is empty list, not null
+			aw, err := wc.vw.WriteArray()
+			if err != nil {
+				return err
+			}
+
+			return aw.WriteArrayEnd()
+		}
+
+		return encodeParam(wc, pv)
+	case reflect.Array:
+		return encodeParam(wc, pv)
+	}
+
+	return fmt.Errorf("parameter %s must be slice or array, got %T", name, pv)
+}
+
 func tokenLength(vt ValueType, buff []byte) (uint32, []byte) {
 	switch vt {
-	case VTString, VTRegex, VTKey:
+	case VTString, VTRegex, VTKey, VTParam, VTArrayParam, VTBinary, VTVar, VTArray, VTDocument:
 		l := binary.BigEndian.Uint32(buff)
 		return l, buff[4:]
 	case VTObjectID:
 		return 12, buff
-	case VTInteger, VTFloat, VTDate:
+	case VTDecimal, VTUUID:
+		return 16, buff
+	case VTInteger, VTFloat, VTDate, VTInt64, VTTimestamp, VTDuration:
 		return 8, buff
+	case VTInt32:
+		return 4, buff
 	case VTBool:
 		return 1, buff
 	}
@@ -3,6 +3,7 @@ package query_test
 import (
 	"context"
 	"fmt"
+	"math"
 	"reflect"
 	"sync"
 	"testing"
@@ -11,6 +12,7 @@ import (
 	"github.com/hummerd/mgx/query"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func TestCompileToBSON(t *testing.T) {
@@ -24,7 +26,7 @@ func TestCompileToBSON(t *testing.T) {
 			name:  "simple number",
 			query: "a = 90",
 			want: &bson.D{
-				{Key: `a`, Value: int64(90)},
+				{Key: `a`, Value: int32(90)},
 			},
 		},
 		{
@@ -60,7 +62,7 @@ func TestCompileToBSON(t *testing.T) {
 			query: `a.c < 'abc' and e = 90`,
 			want: &bson.D{
 				{Key: `a.c`, Value: bson.D{{Key: `$lt`, Value: `abc`}}},
-				{Key: `e`, Value: int64(90)},
+				{Key: `e`, Value: int32(90)},
 			},
 		},
 		{
@@ -82,7 +84,7 @@ func TestCompileToBSON(t *testing.T) {
 						{Key: `a.c`, Value: bson.D{{Key: `$gt`, Value: `abc`}}},
 						{Key: `f`, Value: `some`},
 					},
-					bson.D{{Key: `e`, Value: int64(90)}},
+					bson.D{{Key: `e`, Value: int32(90)}},
 				}},
 			},
 		},
@@ -95,8 +97,8 @@ func TestCompileToBSON(t *testing.T) {
 						{Key: `a.c`, Value: bson.D{{Key: `$lte`, Value: `abc`}}},
 						{Key: `f`, Value: `some`},
 					},
-					bson.D{{Key: `e`, Value: int64(90)}},
-					bson.D{{Key: `g`, Value: int64(100)}},
+					bson.D{{Key: `e`, Value: int32(90)}},
+					bson.D{{Key: `g`, Value: int32(100)}},
 				}},
 			},
 		},
@@ -108,7 +110,7 @@ func TestCompileToBSON(t *testing.T) {
 				{
 					Key: "$or", Value: bson.A{
 						bson.D{{Key: `f`, Value: `some`}},
-						bson.D{{Key: `e`, Value: int64(90)}},
+						bson.D{{Key: `e`, Value: int32(90)}},
 					},
 				},
 			},
@@ -154,9 +156,9 @@ func TestCompileToBSON_Link(t *testing.T) {
 			name:  "simple link number",
 			query: "a > 90 and a < 100",
 			want: &bson.D{
-				{Key: "$and", Value: bson.A{
-					bson.D{{Key: "a", Value: bson.D{{Key: "$gt", Value: int64(90)}}}},
-					bson.D{{Key: "a", Value: bson.D{{Key: "$lt", Value: int64(100)}}}},
+				{Key: "a", Value: bson.D{
+					{Key: "$gt", Value: int32(90)},
+					{Key: "$lt", Value: int32(100)},
 				}},
 			},
 		},
@@ -165,11 +167,31 @@ func TestCompileToBSON_Link(t *testing.T) {
 			query: "(a > 90 and a < 100) or a = 25",
 			want: &bson.D{
 				{Key: "$or", Value: bson.A{
-					bson.D{{Key: "$and", Value: bson.A{
-						bson.D{{Key: "a", Value: bson.D{{Key: "$gt", Value: int64(90)}}}},
-						bson.D{{Key: "a", Value: bson.D{{Key: "$lt", Value: int64(100)}}}},
+					bson.D{{Key: "a", Value: bson.D{
+						{Key: "$gt", Value: int32(90)},
+						{Key: "$lt", Value: int32(100)},
 					}}},
-					bson.D{{Key: "a", Value: int64(25)}},
+					bson.D{{Key: "a", Value: int32(25)}},
+				}},
+			},
+		},
+		{
+			name:  "link same operators",
+			query: "a > 90 and a > 100",
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "a", Value: bson.D{{Key: "$gt", Value: int32(90)}}}},
+					bson.D{{Key: "a", Value: bson.D{{Key: "$gt", Value: int32(100)}}}},
+				}},
+			},
+		},
+		{
+			name:  "link equality",
+			query: "a = 90 and a $exists true",
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "a", Value: int32(90)}},
+					bson.D{{Key: "a", Value: bson.D{{Key: "$exists", Value: true}}}},
 				}},
 			},
 		},
@@ -215,7 +237,7 @@ func TestCompileToBSON_Array(t *testing.T) {
 			query: `a $in [90, "abc", /abc/, ISODate('2022-01-01T00:00:00Z')]`,
 			want: &bson.D{
 				{Key: "a", Value: bson.D{{Key: "$in", Value: bson.A{
-					int64(90),
+					int32(90),
 					"abc",
 					primitive.Regex{Pattern: "abc", Options: ""},
 					time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
@@ -252,117 +274,3871 @@ func TestCompileToBSON_Array(t *testing.T) {
 	}
 }
 
-func printMarshalled(t *testing.T, marshalledQuery []byte) {
-	var q interface{}
-
-	err := bson.Unmarshal(marshalledQuery, &q)
-	if err != nil {
-		t.Fatal(err)
+func TestCompileToBSON_Not(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "not equal",
+			query: `not a = 90`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$ne", Value: int32(90)}}},
+			},
+		},
+		{
+			name:  "not not equal",
+			query: `not a != 90`,
+			want: &bson.D{
+				{Key: "a", Value: int32(90)},
+			},
+		},
+		{
+			name:  "not greater",
+			query: `not a > 90 and b = "abc"`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: int32(90)}}}}},
+				{Key: "b", Value: "abc"},
+			},
+		},
+		{
+			name:  "not in",
+			query: `not a $in [1, 2]`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$nin", Value: bson.A{int32(1), int32(2)}}}},
+			},
+		},
+		{
+			name:  "not exists",
+			query: `not a $exists true`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$exists", Value: false}}},
+			},
+		},
+		{
+			name:  "not regex",
+			query: `not a = /abc/i`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$not", Value: primitive.Regex{Pattern: "abc", Options: "i"}}}},
+			},
+		},
+		{
+			name:  "not or",
+			query: `NOT (status = "done" OR archived = true)`,
+			want: &bson.D{
+				{Key: "$nor", Value: bson.A{
+					bson.D{{Key: "status", Value: "done"}},
+					bson.D{{Key: "archived", Value: true}},
+				}},
+			},
+		},
+		{
+			name:  "not and",
+			query: `a = 1 and !(b = 2 and c = 3)`,
+			want: &bson.D{
+				{Key: "a", Value: int32(1)},
+				{Key: "$nor", Value: bson.A{
+					bson.D{
+						{Key: "b", Value: int32(2)},
+						{Key: "c", Value: int32(3)},
+					},
+				}},
+			},
+		},
+		{
+			name:  "not inside or",
+			query: `a = 1 or not (b = 2 or c = 3)`,
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "a", Value: int32(1)}},
+					bson.D{{Key: "$nor", Value: bson.A{
+						bson.D{{Key: "b", Value: int32(2)}},
+						bson.D{{Key: "c", Value: int32(3)}},
+					}}},
+				}},
+			},
+		},
+		{
+			name:  "not same field",
+			query: `a = 5 and not a = 6`,
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "a", Value: int32(5)}},
+					bson.D{{Key: "a", Value: bson.D{{Key: "$ne", Value: int32(6)}}}},
+				}},
+			},
+		},
+		{
+			name:  "not same field first",
+			query: `not a = 1 and a > 0 and b = 2`,
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "a", Value: bson.D{{Key: "$ne", Value: int32(1)}}}},
+					bson.D{{Key: "a", Value: bson.D{{Key: "$gt", Value: int32(0)}}}},
+					bson.D{{Key: "b", Value: int32(2)}},
+				}},
+			},
+		},
+		{
+			name:  "two not or",
+			query: `not (a = 1 or b = 1) and not (c = 1 or d = 1)`,
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "$nor", Value: bson.A{
+						bson.D{{Key: "a", Value: int32(1)}},
+						bson.D{{Key: "b", Value: int32(1)}},
+					}}},
+					bson.D{{Key: "$nor", Value: bson.A{
+						bson.D{{Key: "c", Value: int32(1)}},
+						bson.D{{Key: "d", Value: int32(1)}},
+					}}},
+				}},
+			},
+		},
+		{
+			name:  "not field comparison",
+			query: `a > b and not c > d`,
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{"$a", "$b"}}}}},
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$lte", Value: bson.A{"$c", "$d"}}}}},
+				}},
+			},
+		},
+		{
+			name:  "two or",
+			query: `(a = 1 or b = 1) and (c = 1 or d = 1)`,
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "$or", Value: bson.A{
+						bson.D{{Key: "a", Value: int32(1)}},
+						bson.D{{Key: "b", Value: int32(1)}},
+					}}},
+					bson.D{{Key: "$or", Value: bson.A{
+						bson.D{{Key: "c", Value: int32(1)}},
+						bson.D{{Key: "d", Value: int32(1)}},
+					}}},
+				}},
+			},
+		},
 	}
 
-	j, _ := bson.MarshalExtJSONIndent(q, false, true, "", " ")
-	t.Log(string(j))
-}
-
-func TestEncoder_ConcurrentEncode(t *testing.T) {
-	pq, err := query.Prepare(`a >= "$prm"`)
-	if err != nil {
-		t.Fatal(err)
-	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	errs := [4]error{}
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	expNumBson := bson.D{
-		{Key: "a", Value: bson.D{{Key: "$gte", Value: 20}}},
-	}
-	expNumBytes, err := bson.Marshal(expNumBson)
-	if err != nil {
-		t.Fatal(err)
-	}
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	wg := sync.WaitGroup{}
+			printMarshalled(t, mq)
 
-	for i := 0; i < 2; i++ {
-		wg.Add(1)
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
 
-		go func(i int) {
-			defer wg.Done()
+func TestCompileToBSON_Operators(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "nin",
+			query: `a $nin [1, "b"]`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$nin", Value: bson.A{int32(1), "b"}}}},
+			},
+		},
+		{
+			name:  "all",
+			query: `tags $all ["a", "b"]`,
+			want: &bson.D{
+				{Key: "tags", Value: bson.D{{Key: "$all", Value: bson.A{"a", "b"}}}},
+			},
+		},
+		{
+			name:  "size",
+			query: `tags $size 2`,
+			want: &bson.D{
+				{Key: "tags", Value: bson.D{{Key: "$size", Value: int32(2)}}},
+			},
+		},
+		{
+			name:    "size not integer",
+			query:   `tags $size 2.5`,
+			wantErr: true,
+		},
+		{
+			name:  "type name",
+			query: `a $type "string"`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$type", Value: "string"}}},
+			},
+		},
+		{
+			name:  "type array",
+			query: `a $type ["int", 18]`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$type", Value: bson.A{"int", int32(18)}}}},
+			},
+		},
+		{
+			name:    "unknown type",
+			query:   `a $type "text"`,
+			wantErr: true,
+		},
+		{
+			name:  "mod",
+			query: `a $mod [4, 0]`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$mod", Value: bson.A{int32(4), int32(0)}}}},
+			},
+		},
+		{
+			name:    "mod wrong shape",
+			query:   `a $mod [4, 0, 1]`,
+			wantErr: true,
+		},
+		{
+			name:  "bits mask",
+			query: `a $bitsAllSet 35`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$bitsAllSet", Value: int32(35)}}},
+			},
+		},
+		{
+			name:  "bits positions",
+			query: `a $bitsAnyClear [1, 5]`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$bitsAnyClear", Value: bson.A{int32(1), int32(5)}}}},
+			},
+		},
+		{
+			name:    "unknown operator",
+			query:   `a foo 5`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown symbolic operator",
+			query:   `a == 5`,
+			wantErr: true,
+		},
+	}
 
-			for {
-				if ctx.Err() != nil {
-					return
-				}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
 
-				q, err := pq.Compile("$prm", 20)
-				if err != nil {
-					errs[i] = err
-					return
-				}
+			if tt.wantErr {
+				return
+			}
 
-				qb, err := q.MarshalBSON()
-				if err != nil {
-					errs[i] = err
-					return
-				}
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
 
-				if !reflect.DeepEqual(qb, expNumBytes) {
-					errs[i] = fmt.Errorf("unexpected num bson")
-					return
-				}
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
 			}
-		}(i)
-	}
 
-	testDate := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+			printMarshalled(t, mq)
 
-	expTimeBson := bson.D{
-		{Key: "a", Value: bson.D{{Key: "$gte", Value: testDate}}},
-	}
-	expTimeBytes, err := bson.Marshal(expTimeBson)
-	if err != nil {
-		t.Fatal(err)
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
 	}
+}
 
-	for i := 2; i < 4; i++ {
-		wg.Add(1)
-
-		go func(i int) {
-			defer wg.Done()
-
-			for {
-				if ctx.Err() != nil {
-					return
-				}
-
-				q, err := pq.Compile("$prm", testDate)
+func TestCompileToBSON_Quantifiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "any",
+			query: `items ANY (price > 10 AND qty < 5)`,
+			want: &bson.D{
+				{Key: "items", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "price", Value: bson.D{{Key: "$gt", Value: int32(10)}}},
+					{Key: "qty", Value: bson.D{{Key: "$lt", Value: int32(5)}}},
+				}}}},
+			},
+		},
+		{
+			name:  "none",
+			query: `items NONE (price > 10) and a = 1`,
+			want: &bson.D{
+				{Key: "items", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "price", Value: bson.D{{Key: "$gt", Value: int32(10)}}},
+				}}}}}},
+				{Key: "a", Value: int32(1)},
+			},
+		},
+		{
+			name:  "all",
+			query: `items ALL (price > 10 or qty = 0)`,
+			want: &bson.D{
+				{Key: "items", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "$nor", Value: bson.A{
+						bson.D{{Key: "$or", Value: bson.A{
+							bson.D{{Key: "price", Value: bson.D{{Key: "$gt", Value: int32(10)}}}},
+							bson.D{{Key: "qty", Value: int32(0)}},
+						}}},
+					}},
+				}}}}}},
+			},
+		},
+		{
+			name:  "not all",
+			query: `not items all (price > 10)`,
+			want: &bson.D{
+				{Key: "items", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "$nor", Value: bson.A{
+						bson.D{{Key: "price", Value: bson.D{{Key: "$gt", Value: int32(10)}}}},
+					}},
+				}}}},
+			},
+		},
+		{
+			name:  "nested",
+			query: `orders any (items any (qty > 1))`,
+			want: &bson.D{
+				{Key: "orders", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "items", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+						{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(1)}}},
+					}}}},
+				}}}},
+			},
+		},
+		{
+			name:    "no field",
+			query:   `5 any (a = 1)`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_FieldComparison(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "fields",
+			query: `updatedAt > createdAt`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{"$updatedAt", "$createdAt"}}}},
+			},
+		},
+		{
+			name:  "fields and value",
+			query: `a = 1 and b != c`,
+			want: &bson.D{
+				{Key: "a", Value: int32(1)},
+				{Key: "$expr", Value: bson.D{{Key: "$ne", Value: bson.A{"$b", "$c"}}}},
+			},
+		},
+		{
+			name:  "multiple fields",
+			query: `a >= b and c < d`,
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$gte", Value: bson.A{"$a", "$b"}}}}},
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$lt", Value: bson.A{"$c", "$d"}}}}},
+				}},
+			},
+		},
+		{
+			name:  "fields in or",
+			query: `a = 1 or b <= c`,
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "a", Value: int32(1)}},
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$lte", Value: bson.A{"$b", "$c"}}}}},
+				}},
+			},
+		},
+		{
+			name:  "not fields",
+			query: `not a < b`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gte", Value: bson.A{"$a", "$b"}}}},
+			},
+		},
+		{
+			name:  "null is not field",
+			query: `a = null`,
+			want: &bson.D{
+				{Key: "a", Value: nil},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Calc(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "multiply",
+			query: `price * qty > 1000`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+					bson.D{{Key: "$multiply", Value: bson.A{"$price", "$qty"}}},
+					int32(1000),
+				}}}},
+			},
+		},
+		{
+			name:  "parentheses first",
+			query: `(a + b) * 2 > c and (d = 1 or (e - 1) / 2 = 3)`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+					bson.D{{Key: "$multiply", Value: bson.A{
+						bson.D{{Key: "$add", Value: bson.A{"$a", "$b"}}},
+						int32(2),
+					}}},
+					"$c",
+				}}}},
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "d", Value: int32(1)}},
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{
+						bson.D{{Key: "$divide", Value: bson.A{
+							bson.D{{Key: "$subtract", Value: bson.A{"$e", int32(1)}}},
+							int32(2),
+						}}},
+						int32(3),
+					}}}}},
+				}},
+			},
+		},
+		{
+			name:  "precedence",
+			query: `a + b * 2 - 1 <= c`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$lte", Value: bson.A{
+					bson.D{{Key: "$subtract", Value: bson.A{
+						bson.D{{Key: "$add", Value: bson.A{
+							"$a",
+							bson.D{{Key: "$multiply", Value: bson.A{"$b", int32(2)}}},
+						}}},
+						int32(1),
+					}}},
+					"$c",
+				}}}},
+			},
+		},
+		{
+			name:  "functions",
+			query: `strLen(name) > 5 and size(tags) >= 3`,
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+						bson.D{{Key: "$strLenCP", Value: bson.A{"$name"}}},
+						int32(5),
+					}}}}},
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$gte", Value: bson.A{
+						bson.D{{Key: "$size", Value: bson.A{"$tags"}}},
+						int32(3),
+					}}}}},
+				}},
+			},
+		},
+		{
+			name:  "division and regex",
+			query: `a / 2 = 1 and b $regex /x/`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{
+					bson.D{{Key: "$divide", Value: bson.A{"$a", int32(2)}}},
+					int32(1),
+				}}}},
+				{Key: "b", Value: bson.D{{Key: "$regex", Value: primitive.Regex{Pattern: "x"}}}},
+			},
+		},
+		{
+			name:  "literal string",
+			query: `concat(a, "$b") = "c"`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{
+					bson.D{{Key: "$concat", Value: bson.A{"$a", bson.D{{Key: "$literal", Value: "$b"}}}}},
+					"c",
+				}}}},
+			},
+		},
+		{
+			name:  "negative number",
+			query: `a > -5`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$gt", Value: int32(-5)}}},
+			},
+		},
+		{
+			name:  "not calculated",
+			query: `not a % 2 = 0`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$ne", Value: bson.A{
+					bson.D{{Key: "$mod", Value: bson.A{"$a", int32(2)}}},
+					int32(0),
+				}}}},
+			},
+		},
+		{
+			name:    "calculated operand with field operator",
+			query:   `a * 2 $in [1, 2]`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Range(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "between",
+			query: `age BETWEEN 30 AND 40`,
+			want: &bson.D{
+				{Key: "age", Value: bson.D{
+					{Key: "$gte", Value: int32(30)},
+					{Key: "$lte", Value: int32(40)},
+				}},
+			},
+		},
+		{
+			name:  "between half open interval",
+			query: `age between [30, 40) and name = "x"`,
+			want: &bson.D{
+				{Key: "age", Value: bson.D{
+					{Key: "$gte", Value: int32(30)},
+					{Key: "$lt", Value: int32(40)},
+				}},
+				{Key: "name", Value: "x"},
+			},
+		},
+		{
+			name:  "between exclusive interval",
+			query: `age between (30, 40)`,
+			want: &bson.D{
+				{Key: "age", Value: bson.D{
+					{Key: "$gt", Value: int32(30)},
+					{Key: "$lt", Value: int32(40)},
+				}},
+			},
+		},
+		{
+			name:  "chained comparison",
+			query: `30 <= age < 40`,
+			want: &bson.D{
+				{Key: "age", Value: bson.D{
+					{Key: "$gte", Value: int32(30)},
+					{Key: "$lt", Value: int32(40)},
+				}},
+			},
+		},
+		{
+			name:  "reversed operands",
+			query: `30 < age and 50 >= weight`,
+			want: &bson.D{
+				{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(30)}}},
+				{Key: "weight", Value: bson.D{{Key: "$lte", Value: int32(50)}}},
+			},
+		},
+		{
+			name:  "not between",
+			query: `not age between 30 and 40`,
+			want: &bson.D{
+				{Key: "$nor", Value: bson.A{
+					bson.D{{Key: "age", Value: bson.D{
+						{Key: "$gte", Value: int32(30)},
+						{Key: "$lte", Value: int32(40)},
+					}}},
+				}},
+			},
+		},
+		{
+			name:    "between without and",
+			query:   `age between 30 or 40`,
+			wantErr: true,
+		},
+		{
+			name:    "between wrong interval",
+			query:   `age between [30, 40}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_StringPredicates(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "like",
+			query: `name LIKE "a%b_c"`,
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `^a.*b.c$`, Options: "s"}},
+			},
+		},
+		{
+			name:  "like escapes regex symbols",
+			query: `name like "1+1=2.%"`,
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `^1\+1=2\..*$`, Options: "s"}},
+			},
+		},
+		{
+			name:  "like escaped wildcard",
+			query: `name like "100\\%"`,
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `^100%$`, Options: "s"}},
+			},
+		},
+		{
+			name:  "ilike",
+			query: `name ILIKE "abc%"`,
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `^abc.*$`, Options: "is"}},
+			},
+		},
+		{
+			name:  "not like",
+			query: `not name like "a%"`,
+			want: &bson.D{
+				{Key: "name", Value: bson.D{{Key: "$not", Value: primitive.Regex{Pattern: `^a.*$`, Options: "s"}}}},
+			},
+		},
+		{
+			name:  "startswith",
+			query: `STARTSWITH(name, "a.b*")`,
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `^a\.b\*`}},
+			},
+		},
+		{
+			name:  "endswith",
+			query: `endswith(name, "(z)")`,
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `\(z\)$`}},
+			},
+		},
+		{
+			name:   "contains parameter",
+			query:  `contains(name, $part) and a = 1`,
+			params: []interface{}{"$part", "[x]"},
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `\[x\]`}},
+				{Key: "a", Value: int32(1)},
+			},
+		},
+		{
+			name:   "startswith quoted parameter",
+			query:  `startswith(name, "$prefix")`,
+			params: []interface{}{"$prefix", "a|b"},
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `^a\|b`}},
+			},
+		},
+		{
+			name:  "predicate name as field",
+			query: `contains = 1`,
+			want: &bson.D{
+				{Key: "contains", Value: int32(1)},
+			},
+		},
+		{
+			name:    "parameter is not string",
+			query:   `name like $p`,
+			params:  []interface{}{"$p", 1},
+			wantErr: true,
+		},
+		{
+			name:    "parameter is not set",
+			query:   `contains(name, $p)`,
+			wantErr: true,
+		},
+		{
+			name:    "like number",
+			query:   `name like 5`,
+			wantErr: true,
+		},
+		{
+			name:    "predicate on calculated field",
+			query:   `startswith(a + 1, "x")`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_InParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "in keyword",
+			query: `status IN ["new", "done"]`,
+			want: &bson.D{
+				{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"new", "done"}}}},
+			},
+		},
+		{
+			name:  "not in keyword",
+			query: `status not in [1, 2]`,
+			want: &bson.D{
+				{Key: "status", Value: bson.D{{Key: "$nin", Value: bson.A{int32(1), int32(2)}}}},
+			},
+		},
+		{
+			name:   "in parameter",
+			query:  `status in $statuses`,
+			params: []interface{}{"$statuses", []string{"new", "done"}},
+			want: &bson.D{
+				{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"new", "done"}}}},
+			},
+		},
+		{
+			name:   "in quoted parameter",
+			query:  `status $in "$statuses"`,
+			params: []interface{}{"$statuses", bson.A{"new", 2}},
+			want: &bson.D{
+				{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"new", 2}}}},
+			},
+		},
+		{
+			name:   "nin array parameter",
+			query:  `num $nin $nums`,
+			params: []interface{}{"$nums", [2]int{1, 2}},
+			want: &bson.D{
+				{Key: "num", Value: bson.D{{Key: "$nin", Value: bson.A{1, 2}}}},
+			},
+		},
+		{
+			name:   "not in parameter",
+			query:  `status NOT IN $statuses`,
+			params: []interface{}{"$statuses", []string{"new"}},
+			want: &bson.D{
+				{Key: "status", Value: bson.D{{Key: "$nin", Value: bson.A{"new"}}}},
+			},
+		},
+		{
+			name:   "negated in parameter",
+			query:  `not status in $statuses`,
+			params: []interface{}{"$statuses", []string{"new"}},
+			want: &bson.D{
+				{Key: "status", Value: bson.D{{Key: "$nin", Value: bson.A{"new"}}}},
+			},
+		},
+		{
+			name:   "nil slice parameter",
+			query:  `status in $statuses`,
+			params: []interface{}{"$statuses", []string(nil)},
+			want: &bson.D{
+				{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{}}}},
+			},
+		},
+		{
+			name:   "parameters in array",
+			query:  `status in [$first, "$second", "done"]`,
+			params: []interface{}{"$first", "new", "$second", 2},
+			want: &bson.D{
+				{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"new", 2, "done"}}}},
+			},
+		},
+		{
+			name:    "parameter is not array",
+			query:   `status in $status`,
+			params:  []interface{}{"$status", "new"},
+			wantErr: true,
+		},
+		{
+			name:    "bytes parameter",
+			query:   `status in $status`,
+			params:  []interface{}{"$status", []byte("new")},
+			wantErr: true,
+		},
+		{
+			name:    "parameter is not set",
+			query:   `status in $statuses`,
+			wantErr: true,
+		},
+		{
+			name:    "in value",
+			query:   `status in "new"`,
+			wantErr: true,
+		},
+		{
+			name:    "not without in",
+			query:   `status not [1]`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_TypedParams(t *testing.T) {
+	testOID, _ := primitive.ObjectIDFromHex("62b8bc8ac1e8fc7f0a4a3a77")
+	testDate := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:   "object id from hex string",
+			query:  `_id = $id:objectId`,
+			params: []interface{}{"$id", "62b8bc8ac1e8fc7f0a4a3a77"},
+			want: &bson.D{
+				{Key: "_id", Value: testOID},
+			},
+		},
+		{
+			name:   "parameter in document",
+			query:  `key = {owner: $owner:objectId, no: $no:long}`,
+			params: []interface{}{"$owner", testOID, "$no", 5},
+			want: &bson.D{
+				{Key: "key", Value: bson.D{{Key: "owner", Value: testOID}, {Key: "no", Value: int64(5)}}},
+			},
+		},
+		{
+			name:   "object id",
+			query:  `_id = $id:objectId`,
+			params: []interface{}{"$id", testOID},
+			want: &bson.D{
+				{Key: "_id", Value: testOID},
+			},
+		},
+		{
+			name:    "invalid object id",
+			query:   `_id = $id:objectId`,
+			params:  []interface{}{"$id", "62b8"},
+			wantErr: true,
+		},
+		{
+			name:   "object id list",
+			query:  `_id IN $ids:[objectId]`,
+			params: []interface{}{"$ids", []string{"62b8bc8ac1e8fc7f0a4a3a77"}},
+			want: &bson.D{
+				{Key: "_id", Value: bson.D{{Key: "$in", Value: bson.A{testOID}}}},
+			},
+		},
+		{
+			name:    "wrong list element",
+			query:   `_id IN $ids:[objectId]`,
+			params:  []interface{}{"$ids", bson.A{"62b8bc8ac1e8fc7f0a4a3a77", 1}},
+			wantErr: true,
+		},
+		{
+			name:    "scalar type in list",
+			query:   `_id IN $id:objectId`,
+			params:  []interface{}{"$id", "62b8bc8ac1e8fc7f0a4a3a77"},
+			wantErr: true,
+		},
+		{
+			name:   "date",
+			query:  `created >= $start:date`,
+			params: []interface{}{"$start", testDate},
+			want: &bson.D{
+				{Key: "created", Value: bson.D{{Key: "$gte", Value: testDate}}},
+			},
+		},
+		{
+			name:   "date from string",
+			query:  `created >= $start:date`,
+			params: []interface{}{"$start", "2022-01-01T00:00:00Z"},
+			want: &bson.D{
+				{Key: "created", Value: bson.D{{Key: "$gte", Value: testDate}}},
+			},
+		},
+		{
+			name:   "date from short string",
+			query:  `created >= $start:date`,
+			params: []interface{}{"$start", "2022-01-01"},
+			want: &bson.D{
+				{Key: "created", Value: bson.D{{Key: "$gte", Value: testDate}}},
+			},
+		},
+		{
+			name:  "date default",
+			query: `created >= $start:date = "2022-01-01"`,
+			want: &bson.D{
+				{Key: "created", Value: bson.D{{Key: "$gte", Value: testDate}}},
+			},
+		},
+		{
+			name:   "parameter on the left side",
+			query:  `$min:int < qty and $name:string = name`,
+			params: []interface{}{"$min", 5, "$name", "bob"},
+			want: &bson.D{
+				{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(5)}}},
+				{Key: "name", Value: "bob"},
+			},
+		},
+		{
+			name:   "string parameter in calculation",
+			query:  `price * qty > $limit and a + 1 = $b:string`,
+			params: []interface{}{"$limit", "$secret", "$b", "$c"},
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+						bson.D{{Key: "$multiply", Value: bson.A{"$price", "$qty"}}},
+						bson.D{{Key: "$literal", Value: "$secret"}},
+					}}}}},
+					bson.D{{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{
+						bson.D{{Key: "$add", Value: bson.A{"$a", int32(1)}}},
+						bson.D{{Key: "$literal", Value: "$c"}},
+					}}}}},
+				}},
+			},
+		},
+		{
+			name:    "wrong date",
+			query:   `created >= $start:date`,
+			params:  []interface{}{"$start", 1},
+			wantErr: true,
+		},
+		{
+			name:  "default",
+			query: `a < $limit:int = 10`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$lt", Value: int32(10)}}},
+			},
+		},
+		{
+			name:   "default is overridden",
+			query:  `a < $limit:int = 10`,
+			params: []interface{}{"$limit", uint8(5)},
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$lt", Value: int32(5)}}},
+			},
+		},
+		{
+			name:    "int overflow",
+			query:   `a < $limit:int`,
+			params:  []interface{}{"$limit", int64(math.MaxInt32 + 1)},
+			wantErr: true,
+		},
+		{
+			name:   "long and double",
+			query:  `a = $a:long and b = $b:double`,
+			params: []interface{}{"$a", 1, "$b", 2},
+			want: &bson.D{
+				{Key: "a", Value: int64(1)},
+				{Key: "b", Value: float64(2)},
+			},
+		},
+		{
+			name:  "list default",
+			query: `tag in $tags:[string] = ["a", "b"]`,
+			want: &bson.D{
+				{Key: "tag", Value: bson.D{{Key: "$in", Value: bson.A{"a", "b"}}}},
+			},
+		},
+		{
+			name:   "declared once",
+			query:  `a = $s:string or b = $s`,
+			params: []interface{}{"$s", "x"},
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "a", Value: "x"}},
+					bson.D{{Key: "b", Value: "x"}},
+				}},
+			},
+		},
+		{
+			name:    "not set",
+			query:   `a = $s:string`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong default",
+			query:   `a < $limit:int = "10"`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			query:   `a < $limit:integer`,
+			wantErr: true,
+		},
+		{
+			name:    "redeclared",
+			query:   `a = $s:string or b = $s:int`,
+			params:  []interface{}{"$s", "x"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+// testPoint and testBound mimic geometries of github.com/paulmach/orb.
+type testPoint [2]float64
+
+func (testPoint) GeoJSONType() string { return "Point" }
+
+type testBound struct {
+	Min, Max testPoint
+}
+
+func (testBound) GeoJSONType() string { return "Polygon" }
+
+// testLine is a GeoJSON value of its own type.
+type testLine struct {
+	Type        string       `bson:"type"`
+	Coordinates [][2]float64 `bson:"coordinates"`
+}
+
+func (testLine) GeoJSONType() string { return "LineString" }
+
+func TestCompileToBSON_Geo(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "near",
+			query: `loc NEAR point(-73.9, 40.7) WITHIN 1.5km`,
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$near", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{
+						{Key: "type", Value: "Point"},
+						{Key: "coordinates", Value: bson.A{-73.9, 40.7}},
+					}},
+					{Key: "$maxDistance", Value: 1500.0},
+				}}}},
+			},
+		},
+		{
+			name:  "near unit after space",
+			query: `loc NEAR point(1, 2) WITHIN 500 m and a = 1`,
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$near", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{
+						{Key: "type", Value: "Point"},
+						{Key: "coordinates", Value: bson.A{1.0, 2.0}},
+					}},
+					{Key: "$maxDistance", Value: 500.0},
+				}}}},
+				{Key: "a", Value: int32(1)},
+			},
+		},
+		{
+			name:   "near sphere parameters",
+			query:  `loc near sphere $p within $d`,
+			params: []interface{}{"$p", testPoint{1, 2}, "$d", 100},
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$nearSphere", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{
+						{Key: "type", Value: "Point"},
+						{Key: "coordinates", Value: bson.A{1.0, 2.0}},
+					}},
+					{Key: "$maxDistance", Value: 100},
+				}}}},
+			},
+		},
+		{
+			name:  "within box",
+			query: `loc WITHIN box(0, 0, 10, 5)`,
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$geoWithin", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{
+						{Key: "type", Value: "Polygon"},
+						{Key: "coordinates", Value: bson.A{bson.A{
+							bson.A{0.0, 0.0}, bson.A{10.0, 0.0}, bson.A{10.0, 5.0}, bson.A{0.0, 5.0}, bson.A{0.0, 0.0},
+						}}},
+					}},
+				}}}},
+			},
+		},
+		{
+			name:  "within polygon",
+			query: `loc within polygon([[0, 0], [1, 0], [1, 1]])`,
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$geoWithin", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{
+						{Key: "type", Value: "Polygon"},
+						{Key: "coordinates", Value: bson.A{bson.A{
+							bson.A{0.0, 0.0}, bson.A{1.0, 0.0}, bson.A{1.0, 1.0}, bson.A{0.0, 0.0},
+						}}},
+					}},
+				}}}},
+			},
+		},
+		{
+			name:  "within circle",
+			query: `loc within circle(1, 2, 6378.1km)`,
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$geoWithin", Value: bson.D{
+					{Key: "$centerSphere", Value: bson.A{bson.A{1.0, 2.0}, 1.0}},
+				}}}},
+			},
+		},
+		{
+			name:   "within bound parameter",
+			query:  `loc within $b`,
+			params: []interface{}{"$b", testBound{Min: testPoint{0, 0}, Max: testPoint{1, 2}}},
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$geoWithin", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{
+						{Key: "type", Value: "Polygon"},
+						{Key: "coordinates", Value: bson.A{bson.A{
+							bson.A{0.0, 0.0}, bson.A{1.0, 0.0}, bson.A{1.0, 2.0}, bson.A{0.0, 2.0}, bson.A{0.0, 0.0},
+						}}},
+					}},
+				}}}},
+			},
+		},
+		{
+			name:  "intersects geojson parameter",
+			query: `not loc INTERSECTS $g`,
+			params: []interface{}{"$g", bson.D{
+				{Key: "type", Value: "LineString"},
+				{Key: "coordinates", Value: bson.A{bson.A{0, 0}, bson.A{1, 1}}},
+			}},
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$geoIntersects", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{
+						{Key: "type", Value: "LineString"},
+						{Key: "coordinates", Value: bson.A{bson.A{0, 0}, bson.A{1, 1}}},
+					}},
+				}}}}}},
+			},
+		},
+		{
+			name:   "intersects custom geojson parameter",
+			query:  `loc INTERSECTS $g`,
+			params: []interface{}{"$g", testLine{Type: "LineString", Coordinates: [][2]float64{{0, 0}, {1, 1}}}},
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$geoIntersects", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{
+						{Key: "type", Value: "LineString"},
+						{Key: "coordinates", Value: bson.A{bson.A{0.0, 0.0}, bson.A{1.0, 1.0}}},
+					}},
+				}}}},
+			},
+		},
+		{
+			name:    "negated near",
+			query:   `not loc near point(1, 2)`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid coordinates",
+			query:   `loc near point(1, 91)`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown geometry",
+			query:   `loc within line([[0, 0], [1, 1]])`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong parameter",
+			query:   `loc within $g`,
+			params:  []interface{}{"$g", "point"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Text(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "text",
+			query: `TEXT("coffee shop" LANGUAGE 'en' CASE_SENSITIVE) and price < 10`,
+			want: &bson.D{
+				{Key: "$text", Value: bson.D{
+					{Key: "$search", Value: "coffee shop"},
+					{Key: "$language", Value: "en"},
+					{Key: "$caseSensitive", Value: true},
+				}},
+				{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(10)}}},
+			},
+		},
+		{
+			name:   "text parameters",
+			query:  `a = 1 and (b = 2 or c = 3) and text($search language $lang diacritic_sensitive)`,
+			params: []interface{}{"$search", "tea", "$lang", "es"},
+			want: &bson.D{
+				{Key: "a", Value: int32(1)},
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "b", Value: int32(2)}},
+					bson.D{{Key: "c", Value: int32(3)}},
+				}},
+				{Key: "$text", Value: bson.D{
+					{Key: "$search", Value: "tea"},
+					{Key: "$language", Value: "es"},
+					{Key: "$diacriticSensitive", Value: true},
+				}},
+			},
+		},
+		{
+			name:  "text as field",
+			query: `text = "x"`,
+			want: &bson.D{
+				{Key: "text", Value: "x"},
+			},
+		},
+		{
+			name:    "text inside or",
+			query:   `a = 1 or text("x")`,
+			wantErr: true,
+		},
+		{
+			name:    "negated text",
+			query:   `not text("x")`,
+			wantErr: true,
+		},
+		{
+			name:    "text in array quantifier",
+			query:   `tags any (text("x"))`,
+			wantErr: true,
+		},
+		{
+			name:    "text twice",
+			query:   `text("x") and a = 1 and text("y")`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown text option",
+			query:   `text("x" fuzzy)`,
+			wantErr: true,
+		},
+		{
+			name:    "text search number",
+			query:   `text(1)`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func testDecimal(s string) primitive.Decimal128 {
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return d
+}
+
+func TestCompileToBSON_Literals(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "decimal",
+			query: `price = NumberDecimal("12.30") and cost > NumberDecimal(-1.5)`,
+			want: &bson.D{
+				{Key: "price", Value: testDecimal("12.30")},
+				{Key: "cost", Value: bson.D{{Key: "$gt", Value: testDecimal("-1.5")}}},
+			},
+		},
+		{
+			name:  "int and long",
+			query: `a = NumberInt(-5) and b = NumberLong("9007199254740993")`,
+			want: &bson.D{
+				{Key: "a", Value: int32(-5)},
+				{Key: "b", Value: int64(9007199254740993)},
+			},
+		},
+		{
+			name:  "uuid and binary",
+			query: `u = UUID("123e4567-e89b-12d3-a456-426614174000") and b = BinData(0, "AQID")`,
+			want: &bson.D{
+				{Key: "u", Value: primitive.Binary{Subtype: 4, Data: []byte{
+					0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00,
+				}}},
+				{Key: "b", Value: primitive.Binary{Data: []byte{1, 2, 3}}},
+			},
+		},
+		{
+			name:  "timestamp and keys",
+			query: `t > Timestamp(1650000000, 2) and k > MinKey and m < MaxKey()`,
+			want: &bson.D{
+				{Key: "t", Value: bson.D{{Key: "$gt", Value: primitive.Timestamp{T: 1650000000, I: 2}}}},
+				{Key: "k", Value: bson.D{{Key: "$gt", Value: primitive.MinKey{}}}},
+				{Key: "m", Value: bson.D{{Key: "$lt", Value: primitive.MaxKey{}}}},
+			},
+		},
+		{
+			name:  "literals in array",
+			query: `a in [null, NumberInt(1), BinData(5, "AQ==")]`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$in", Value: bson.A{
+					nil, int32(1), primitive.Binary{Subtype: 5, Data: []byte{1}},
+				}}}},
+			},
+		},
+		{
+			name:  "literal in calculation",
+			query: `a + NumberInt(1) > NumberDecimal("2.5")`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+					bson.D{{Key: "$add", Value: bson.A{"$a", int32(1)}}},
+					testDecimal("2.5"),
+				}}}},
+			},
+		},
+		{
+			name:    "int overflow",
+			query:   `a = NumberInt(3000000000)`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid uuid",
+			query:   `a = UUID("123e4567")`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid base64",
+			query:   `a = BinData(0, "!!")`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid decimal",
+			query:   `a = NumberDecimal("1,5")`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Numbers(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "negative",
+			query: `balance > -5 and debt $lt -0.5`,
+			want: &bson.D{
+				{Key: "balance", Value: bson.D{{Key: "$gt", Value: int32(-5)}}},
+				{Key: "debt", Value: bson.D{{Key: "$lt", Value: -0.5}}},
+			},
+		},
+		{
+			name:  "exponent hex and separators",
+			query: `a = 1e6 and b = 2.5E-3 and c = 0xFF and d = 1_000_000`,
+			want: &bson.D{
+				{Key: "a", Value: 1e6},
+				{Key: "b", Value: 2.5e-3},
+				{Key: "c", Value: int32(255)},
+				{Key: "d", Value: int32(1000000)},
+			},
+		},
+		{
+			name:  "int64",
+			query: `a = 3000000000 and b = -2147483649 and c = 2147483647`,
+			want: &bson.D{
+				{Key: "a", Value: int64(3000000000)},
+				{Key: "b", Value: int64(-2147483649)},
+				{Key: "c", Value: int32(2147483647)},
+			},
+		},
+		{
+			name:  "leading zeros",
+			query: `a = 010 and b = 08 and c in [0017, 1] and d = -0x1F`,
+			want: &bson.D{
+				{Key: "a", Value: int32(10)},
+				{Key: "b", Value: int32(8)},
+				{Key: "c", Value: bson.D{{Key: "$in", Value: bson.A{int32(17), int32(1)}}}},
+				{Key: "d", Value: int32(-31)},
+			},
+		},
+		{
+			name:  "fraction without integer part",
+			query: `a = .5 and b > .25e1`,
+			want: &bson.D{
+				{Key: "a", Value: 0.5},
+				{Key: "b", Value: bson.D{{Key: "$gt", Value: 2.5}}},
+			},
+		},
+		{
+			name:    "dot is not a number",
+			query:   `a = .`,
+			wantErr: true,
+		},
+		{
+			name:  "signed array elements",
+			query: `a in [-1, +2, -.5]`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$in", Value: bson.A{int32(-1), int32(2), -0.5}}}},
+			},
+		},
+		{
+			name:  "minus is operator after operand",
+			query: `a -5 > b`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+					bson.D{{Key: "$subtract", Value: bson.A{"$a", int32(5)}}},
+					"$b",
+				}}}},
+			},
+		},
+		{
+			name:    "int64 overflow",
+			query:   `a = 9223372036854775808`,
+			wantErr: true,
+		},
+		{
+			name:    "double overflow",
+			query:   `a = 1e400`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong separator",
+			query:   `a = 1__000`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong number",
+			query:   `a = 1.2.3`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Time(t *testing.T) {
+	now := time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "now",
+			query: `createdAt < NOW()`,
+			want: &bson.D{
+				{Key: "createdAt", Value: bson.D{{Key: "$lt", Value: now}}},
+			},
+		},
+		{
+			name:  "now minus days",
+			query: `createdAt > NOW() - 7d`,
+			want: &bson.D{
+				{Key: "createdAt", Value: bson.D{{Key: "$gt", Value: now.AddDate(0, 0, -7)}}},
+			},
+		},
+		{
+			name:  "compound duration",
+			query: `createdAt > now() - 1h30m`,
+			want: &bson.D{
+				{Key: "createdAt", Value: bson.D{{Key: "$gt", Value: now.Add(-90 * time.Minute)}}},
+			},
+		},
+		{
+			name:  "date plus duration",
+			query: `expiresAt < ISODate("2022-01-01T00:00:00Z") + 2w`,
+			want: &bson.D{
+				{Key: "expiresAt", Value: bson.D{{Key: "$lt", Value: testTime.Truncate(24*time.Hour).AddDate(0, 0, 14)}}},
+			},
+		},
+		{
+			name:   "parameter plus duration",
+			query:  `expiresAt < $start + 2h`,
+			params: []interface{}{"$start", now},
+			want: &bson.D{
+				{Key: "expiresAt", Value: bson.D{{Key: "$lt", Value: now.Add(2 * time.Hour)}}},
+			},
+		},
+		{
+			name:   "duration parameter",
+			query:  `expiresAt < NOW() + $ttl`,
+			params: []interface{}{"$ttl", time.Minute},
+			want: &bson.D{
+				{Key: "expiresAt", Value: bson.D{{Key: "$lt", Value: now.Add(time.Minute)}}},
+			},
+		},
+		{
+			name:  "range",
+			query: `NOW() - 1d < createdAt < NOW()`,
+			want: &bson.D{
+				{Key: "createdAt", Value: bson.D{
+					{Key: "$gt", Value: now.AddDate(0, 0, -1)},
+					{Key: "$lt", Value: now},
+				}},
+			},
+		},
+		{
+			name:  "duration",
+			query: `ttl = 1500ms`,
+			want: &bson.D{
+				{Key: "ttl", Value: int64(1500)},
+			},
+		},
+		{
+			name:  "server time",
+			query: `expiresAt < $$NOW`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$lt", Value: bson.A{"$expiresAt", "$$NOW"}}}},
+			},
+		},
+		{
+			name:  "server time arithmetic",
+			query: `createdAt > $$NOW - 7d`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+					"$createdAt",
+					bson.D{{Key: "$subtract", Value: bson.A{"$$NOW", int64(7 * 24 * time.Hour / time.Millisecond)}}},
+				}}}},
+			},
+		},
+		{
+			name:  "field plus duration",
+			query: `createdAt + 1d > expiresAt`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+					bson.D{{Key: "$add", Value: bson.A{"$createdAt", int64(24 * time.Hour / time.Millisecond)}}},
+					"$expiresAt",
+				}}}},
+			},
+		},
+		{
+			name:    "unknown unit",
+			query:   `createdAt > NOW() - 7q`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong parameter type",
+			query:   `expiresAt < $start + 2h`,
+			params:  []interface{}{"$start", 1},
+			wantErr: true,
+		},
+		{
+			name:    "dates sum",
+			query:   `expiresAt < NOW() + NOW()`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pq, err := query.Prepare(tt.query)
+			if err == nil {
+				pq = pq.WithClock(clock)
+
+				var cq query.CompiledQuery
+				cq, err = pq.Compile(tt.params...)
+				if err == nil {
+					defer cq.Discard()
+
+					var mq []byte
+					mq, err = cq.MarshalBSON()
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					expectedQuery, err := bson.Marshal(tt.want)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					printMarshalled(t, mq)
+
+					if !reflect.DeepEqual(expectedQuery, mq) {
+						t.Errorf("CompileToBSON() = %s, want %s",
+							bson.Raw(mq),
+							bson.Raw(expectedQuery))
+					}
+				}
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompileToBSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Calendar(t *testing.T) {
+	// Wednesday
+	now := time.Date(2022, 6, 15, 22, 30, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	msk, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dateRange := func(start, end time.Time) bson.D {
+		return bson.D{{Key: "$gte", Value: start}, {Key: "$lt", Value: end}}
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		opts    []query.Option
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "today",
+			query: `day = TODAY()`,
+			want: &bson.D{
+				{Key: "day", Value: dateRange(
+					time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC),
+					time.Date(2022, 6, 16, 0, 0, 0, 0, time.UTC))},
+			},
+		},
+		{
+			name:  "today in zone",
+			query: `day = TODAY('Europe/Moscow')`,
+			want: &bson.D{
+				{Key: "day", Value: dateRange(
+					time.Date(2022, 6, 16, 0, 0, 0, 0, msk),
+					time.Date(2022, 6, 17, 0, 0, 0, 0, msk))},
+			},
+		},
+		{
+			name:  "month",
+			query: `createdAt IN MONTH('2022-01')`,
+			want: &bson.D{
+				{Key: "createdAt", Value: dateRange(
+					time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+					time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC))},
+			},
+		},
+		{
+			name:  "month in zone",
+			query: `createdAt IN MONTH("2022-01", "Europe/Moscow")`,
+			want: &bson.D{
+				{Key: "createdAt", Value: dateRange(
+					time.Date(2022, 1, 1, 0, 0, 0, 0, msk),
+					time.Date(2022, 2, 1, 0, 0, 0, 0, msk))},
+			},
+		},
+		{
+			name:   "week of parameter",
+			query:  `createdAt IN WEEK($date)`,
+			params: []interface{}{"$date", time.Date(2022, 6, 19, 12, 0, 0, 0, time.UTC)},
+			want: &bson.D{
+				{Key: "createdAt", Value: dateRange(
+					time.Date(2022, 6, 13, 0, 0, 0, 0, time.UTC),
+					time.Date(2022, 6, 20, 0, 0, 0, 0, time.UTC))},
+			},
+		},
+		{
+			name:   "zone parameter",
+			query:  `createdAt IN DAY($date, $zone)`,
+			params: []interface{}{"$date", "2022-03-05", "$zone", msk},
+			want: &bson.D{
+				{Key: "createdAt", Value: dateRange(
+					time.Date(2022, 3, 5, 0, 0, 0, 0, msk),
+					time.Date(2022, 3, 6, 0, 0, 0, 0, msk))},
+			},
+		},
+		{
+			name:  "year of date",
+			query: `createdAt = YEAR(ISODate("2021-05-01"))`,
+			want: &bson.D{
+				{Key: "createdAt", Value: dateRange(
+					time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))},
+			},
+		},
+		{
+			name:  "not in",
+			query: `createdAt NOT IN WEEK()`,
+			want: &bson.D{
+				{Key: "createdAt", Value: bson.D{{Key: "$not", Value: dateRange(
+					time.Date(2022, 6, 13, 0, 0, 0, 0, time.UTC),
+					time.Date(2022, 6, 20, 0, 0, 0, 0, time.UTC))}}},
+			},
+		},
+		{
+			name:  "negated not equal",
+			query: `not createdAt != MONTH()`,
+			want: &bson.D{
+				{Key: "createdAt", Value: dateRange(
+					time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC),
+					time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC))},
+			},
+		},
+		{
+			name:  "field named as period",
+			query: `a = DAY`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{"$a", "$DAY"}}}},
+			},
+		},
+		{
+			name:  "date only",
+			query: `a = ISODate("2022-01-15")`,
+			want: &bson.D{
+				{Key: "a", Value: time.Date(2022, 1, 15, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:  "date without offset",
+			query: `a = ISODate("2022-01-15T10:30")`,
+			want: &bson.D{
+				{Key: "a", Value: time.Date(2022, 1, 15, 10, 30, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:   "query location",
+			query:  `day = TODAY() and a = ISODate("2022-01-15T10:30") and b > $b:date`,
+			opts:   []query.Option{query.WithLocation(msk)},
+			params: []interface{}{"$b", "2022-01-15"},
+			want: &bson.D{
+				{Key: "day", Value: dateRange(
+					time.Date(2022, 6, 16, 0, 0, 0, 0, msk),
+					time.Date(2022, 6, 17, 0, 0, 0, 0, msk))},
+				{Key: "a", Value: time.Date(2022, 1, 15, 10, 30, 0, 0, msk)},
+				{Key: "b", Value: bson.D{{Key: "$gt", Value: time.Date(2022, 1, 15, 0, 0, 0, 0, msk)}}},
+			},
+		},
+		{
+			name:    "invalid date",
+			query:   `a IN MONTH('2022-13')`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown zone",
+			query:   `a = TODAY('Mars/Base')`,
+			wantErr: true,
+		},
+		{
+			name:    "too many arguments",
+			query:   `a = TODAY('UTC', 'UTC')`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong parameter type",
+			query:   `a IN WEEK($date)`,
+			params:  []interface{}{"$date", 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pq, err := query.Prepare(tt.query, tt.opts...)
+			if err == nil {
+				pq = pq.WithClock(clock)
+
+				var cq query.CompiledQuery
+				cq, err = pq.Compile(tt.params...)
+				if err == nil {
+					defer cq.Discard()
+
+					var mq []byte
+					mq, err = cq.MarshalBSON()
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					expectedQuery, err := bson.Marshal(tt.want)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					printMarshalled(t, mq)
+
+					if !reflect.DeepEqual(expectedQuery, mq) {
+						t.Errorf("CompileToBSON() = %s, want %s",
+							bson.Raw(mq),
+							bson.Raw(expectedQuery))
+					}
+				}
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompileToBSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Comments(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "line comments",
+			query: "// eligible users\nage >= 18 // adults only\nand status = \"active\" -- not banned",
+			want: &bson.D{
+				{Key: "age", Value: bson.D{{Key: "$gte", Value: int32(18)}}},
+				{Key: "status", Value: "active"},
+			},
+		},
+		{
+			name:  "block comment",
+			query: "/* score\n   is normalized */ score / 2 > 1 /* half */",
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+					bson.D{{Key: "$divide", Value: bson.A{"$score", int32(2)}}},
+					int32(1),
+				}}}},
+			},
+		},
+		{
+			name:  "regex and comment",
+			query: `name = /^item/i // prefix`,
+			want: &bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: "^item", Options: "i"}},
+			},
+		},
+		{
+			name:  "minus is not comment",
+			query: `a - -3 > 1`,
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{
+					bson.D{{Key: "$subtract", Value: bson.A{"$a", int32(-3)}}},
+					int32(1),
+				}}}},
+			},
+		},
+		{
+			name:    "not closed comment",
+			query:   `a = 1 /* comment`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_FieldNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "digits",
+			query: `address2 = "Main st." and items.0.price > 5`,
+			want: &bson.D{
+				{Key: "address2", Value: "Main st."},
+				{Key: "items.0.price", Value: bson.D{{Key: "$gt", Value: int32(5)}}},
+			},
+		},
+		{
+			name:  "unicode",
+			query: `имя = "Иван" and größe >= 2`,
+			want: &bson.D{
+				{Key: "имя", Value: "Иван"},
+				{Key: "größe", Value: bson.D{{Key: "$gte", Value: int32(2)}}},
+			},
+		},
+		{
+			name:  "back-quoted",
+			query: "`order` = 1 and `first name` = \"John\" and `not` in [1, 2]",
+			want: &bson.D{
+				{Key: "order", Value: int32(1)},
+				{Key: "first name", Value: "John"},
+				{Key: "not", Value: bson.D{{Key: "$in", Value: bson.A{int32(1), int32(2)}}}},
+			},
+		},
+		{
+			name:  "back-quoted field comparison",
+			query: "total > `max total`",
+			want: &bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{"$total", "$max total"}}}},
+			},
+		},
+		{
+			name:  "positional",
+			query: `items.$.price = 1 and items.$[].qty > 0 and items.$[elem].sku = "a"`,
+			want: &bson.D{
+				{Key: "items.$.price", Value: int32(1)},
+				{Key: "items.$[].qty", Value: bson.D{{Key: "$gt", Value: int32(0)}}},
+				{Key: "items.$[elem].sku", Value: "a"},
+			},
+		},
+		{
+			name:    "empty back-quoted",
+			query:   "`` = 1",
+			wantErr: true,
+		},
+		{
+			name:    "not a letter",
+			query:   `price€ = 1`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Strings(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "escaped quotes",
+			query: `title = "say \"hi\"" and note = 'it\'s'`,
+			want: &bson.D{
+				{Key: "title", Value: `say "hi"`},
+				{Key: "note", Value: "it's"},
+			},
+		},
+		{
+			name:  "control escapes",
+			query: `a = "tab\tnew\nline\\ \/ \b\f\r"`,
+			want: &bson.D{
+				{Key: "a", Value: "tab\tnew\nline\\ / \b\f\r"},
+			},
+		},
+		{
+			name:  "unicode escapes",
+			query: `a = "caf\u00e9 \ud83d\ude00" and b = "\u0416"`,
+			want: &bson.D{
+				{Key: "a", Value: "café 😀"},
+				{Key: "b", Value: "Ж"},
+			},
+		},
+		{
+			name:  "escaped quote in long string",
+			query: `a = "long string with \"quoted\" words and \\" and b = 1`,
+			want: &bson.D{
+				{Key: "a", Value: `long string with "quoted" words and \`},
+				{Key: "b", Value: int32(1)},
+			},
+		},
+		{
+			name:  "escapes in list",
+			query: `a in ["\"x\"", 'y\'']`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{{Key: "$in", Value: bson.A{`"x"`, "y'"}}}},
+			},
+		},
+		{
+			name:    "invalid escape",
+			query:   `a = "\x41"`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid unicode escape",
+			query:   `a = "\u00g1"`,
+			wantErr: true,
+		},
+		{
+			name:    "lone surrogate",
+			query:   `a = "\ud83d"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Documents(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "document",
+			query: `addr = {street: "Main", no: 5}`,
+			want: &bson.D{
+				{Key: "addr", Value: bson.D{{Key: "street", Value: "Main"}, {Key: "no", Value: int32(5)}}},
+			},
+		},
+		{
+			name:  "nested array",
+			query: `a = [1, [2, 3], []]`,
+			want: &bson.D{
+				{Key: "a", Value: bson.A{int32(1), bson.A{int32(2), int32(3)}, bson.A{}}},
+			},
+		},
+		{
+			name:  "quoted field names and literals",
+			query: "key = {\"first name\": 'John', `no`: NumberLong(5), d: ISODate(\"2022-01-01T04:05:11Z\"), n: null, tags: [\"a\"]}",
+			want: &bson.D{
+				{Key: "key", Value: bson.D{
+					{Key: "first name", Value: "John"},
+					{Key: "no", Value: int64(5)},
+					{Key: "d", Value: testTime},
+					{Key: "n", Value: nil},
+					{Key: "tags", Value: bson.A{"a"}},
+				}},
+			},
+		},
+		{
+			name:  "not equal document",
+			query: `not key = {a: 1, b: {c: true}}`,
+			want: &bson.D{
+				{Key: "key", Value: bson.D{{Key: "$ne", Value: bson.D{
+					{Key: "a", Value: int32(1)},
+					{Key: "b", Value: bson.D{{Key: "c", Value: true}}},
+				}}}},
+			},
+		},
+		{
+			name:  "in documents",
+			query: `key in [{a: 1}, {a: 2}] and tags $all [["x", "y"], "z"]`,
+			want: &bson.D{
+				{Key: "key", Value: bson.D{{Key: "$in", Value: bson.A{
+					bson.D{{Key: "a", Value: int32(1)}},
+					bson.D{{Key: "a", Value: int32(2)}},
+				}}}},
+				{Key: "tags", Value: bson.D{{Key: "$all", Value: bson.A{bson.A{"x", "y"}, "z"}}}},
+			},
+		},
+		{
+			name:  "elem match",
+			query: `items $elemMatch {qty: {$gt: 5}, sku: "x"}`,
+			want: &bson.D{
+				{Key: "items", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(5)}}},
+					{Key: "sku", Value: "x"},
+				}}}},
+			},
+		},
+		{
+			name:  "empty document",
+			query: `a = {}`,
+			want: &bson.D{
+				{Key: "a", Value: bson.D{}},
+			},
+		},
+		{
+			name:    "field without value",
+			query:   `a = {b: c}`,
+			wantErr: true,
+		},
+		{
+			name:    "trailing comma",
+			query:   `a = {b: 1,}`,
+			wantErr: true,
+		},
+		{
+			name:    "elem match value",
+			query:   `a $elemMatch 5`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_JSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "json schema clause",
+			query: `JSON({"$jsonSchema": {"required": ["name"]}}) and age >= 18`,
+			want: &bson.D{
+				{Key: "$jsonSchema", Value: bson.D{{Key: "required", Value: bson.A{"name"}}}},
+				{Key: "age", Value: bson.D{{Key: "$gte", Value: int32(18)}}},
+			},
+		},
+		{
+			name:  "text is not tokenized",
+			query: "JSON({\"a\": \"x) 5km @b `c`\", \"b\": [\"\\\")\"]})",
+			want: &bson.D{
+				{Key: "a", Value: "x) 5km @b `c`"},
+				{Key: "b", Value: bson.A{"\")"}},
+			},
+		},
+		{
+			name:  "same field as clause",
+			query: `JSON({"a": 1}) and a = 2`,
+			want: &bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "a", Value: int32(1)}},
+					bson.D{{Key: "a", Value: int32(2)}},
+				}},
+			},
+		},
+		{
+			name:    "comment in json",
+			query:   `JSON({"a": /* one */ 1})`,
+			wantErr: true,
+		},
+		{
+			name:   "field operators with parameters",
+			query:  `loc JSON({"$near": {"$geometry": "$point", "$maxDistance": "$dist"}})`,
+			params: []interface{}{"$point", bson.D{{Key: "type", Value: "Point"}, {Key: "coordinates", Value: bson.A{1.5, 2.5}}}, "$dist", 100},
+			want: &bson.D{
+				{Key: "loc", Value: bson.D{{Key: "$near", Value: bson.D{
+					{Key: "$geometry", Value: bson.D{{Key: "type", Value: "Point"}, {Key: "coordinates", Value: bson.A{1.5, 2.5}}}},
+					{Key: "$maxDistance", Value: 100},
+				}}}},
+			},
+		},
+		{
+			name:   "extended json types",
+			query:  `JSON({"d": {"$date": "2022-01-01T04:05:11Z"}, "n": {"$numberLong": "5"}, "s": {"$in": ["$a", "$b"]}})`,
+			params: []interface{}{"$a", "x"},
+			want: &bson.D{
+				{Key: "d", Value: testTime},
+				{Key: "n", Value: int64(5)},
+				{Key: "s", Value: bson.D{{Key: "$in", Value: bson.A{"x", "$b"}}}},
+			},
+		},
+		{
+			name:  "negated clause",
+			query: `not JSON({"a": 1, "b": {"$gt": 2}})`,
+			want: &bson.D{
+				{Key: "$nor", Value: bson.A{bson.D{
+					{Key: "a", Value: int32(1)},
+					{Key: "b", Value: bson.D{{Key: "$gt", Value: int32(2)}}},
+				}}},
+			},
+		},
+		{
+			name:  "negated field operators",
+			query: `not tags JSON({"$size": 2})`,
+			want: &bson.D{
+				{Key: "tags", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$size", Value: int32(2)}}}}},
+			},
+		},
+		{
+			name:  "in or",
+			query: `a = 1 or JSON({"b": 2})`,
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "a", Value: int32(1)}},
+					bson.D{{Key: "b", Value: int32(2)}},
+				}},
+			},
+		},
+		{
+			name:  "field named JSON",
+			query: `JSON = 1`,
+			want: &bson.D{
+				{Key: "JSON", Value: int32(1)},
+			},
+		},
+		{
+			name:    "invalid json",
+			query:   `JSON({a: 1})`,
+			wantErr: true,
+		},
+		{
+			name:    "not closed",
+			query:   `JSON({"a": 1}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a document",
+			query:   `a JSON(5)`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Optional(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:   "all set",
+			query:  `?status = $status and ?age >= $age and deleted = false`,
+			params: []interface{}{"$status", "active", "$age", 18},
+			want: &bson.D{
+				{Key: "status", Value: "active"},
+				{Key: "age", Value: bson.D{{Key: "$gte", Value: 18}}},
+				{Key: "deleted", Value: false},
+			},
+		},
+		{
+			name:   "missing nil and omit",
+			query:  `?status = $status and ?age >= $age and ?city = $city and deleted = false`,
+			params: []interface{}{"$age", nil, "$city", query.Omit},
+			want: &bson.D{
+				{Key: "deleted", Value: false},
+			},
+		},
+		{
+			name:  "all omitted",
+			query: `?status = $status and OPTIONAL(age >= $age)`,
+			want:  &bson.D{},
+		},
+		{
+			name:   "optional group in or",
+			query:  `deleted = false and (OPTIONAL(name = $name or nick = $name) or ?email = $email)`,
+			params: []interface{}{"$email", "a@b.c"},
+			want: &bson.D{
+				{Key: "deleted", Value: false},
+				{Key: "email", Value: "a@b.c"},
+			},
+		},
+		{
+			name:  "omitted first in root or",
+			query: `?a = $a or b = 1`,
+			want: &bson.D{
+				{Key: "b", Value: int32(1)},
+			},
+		},
+		{
+			name:  "omitted last in root or",
+			query: `b = 1 or ?a = $a`,
+			want: &bson.D{
+				{Key: "b", Value: int32(1)},
+			},
+		},
+		{
+			name:   "set in root or",
+			query:  `b = 1 or ?a = $a or ?c = $c`,
+			params: []interface{}{"$a", 2},
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "b", Value: int32(1)}},
+					bson.D{{Key: "a", Value: 2}},
+				}},
+			},
+		},
+		{
+			name:   "optional group set",
+			query:  `deleted = false and ?(name = $name or nick = $name)`,
+			params: []interface{}{"$name", "john"},
+			want: &bson.D{
+				{Key: "deleted", Value: false},
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "name", Value: "john"}},
+					bson.D{{Key: "nick", Value: "john"}},
+				}},
+			},
+		},
+		{
+			name:   "optional range is linked",
+			query:  `?price >= $min and ?price < $max and price != 0`,
+			params: []interface{}{"$min", 10, "$max", 20},
+			want: &bson.D{
+				{Key: "price", Value: bson.D{
+					{Key: "$gte", Value: 10},
+					{Key: "$lt", Value: 20},
+					{Key: "$ne", Value: int32(0)},
+				}},
+			},
+		},
+		{
+			name:   "negated optional",
+			query:  `not ?status = $status and not ?role = $role`,
+			params: []interface{}{"$role", "admin"},
+			want: &bson.D{
+				{Key: "role", Value: bson.D{{Key: "$ne", Value: "admin"}}},
+			},
+		},
+		{
+			name:  "typed parameter without default",
+			query: `?limit < $limit:int and a = 1`,
+			want: &bson.D{
+				{Key: "a", Value: int32(1)},
+			},
+		},
+		{
+			name:  "typed parameter with default",
+			query: `?limit < $limit:int = 10`,
+			want: &bson.D{
+				{Key: "limit", Value: bson.D{{Key: "$lt", Value: int32(10)}}},
+			},
+		},
+		{
+			name:   "optional in quantifier",
+			query:  `items ANY (qty > 1 and ?sku = $sku)`,
+			params: []interface{}{"$sku", query.Omit},
+			want: &bson.D{
+				{Key: "items", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(1)}}},
+				}}}},
+			},
+		},
+		{
+			name:  "only optional in quantifier",
+			query: `items ANY (?sku = $sku) and tags ALL (OPTIONAL(name = $tag or code = $tag)) and qty > 1`,
+			want: &bson.D{
+				{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(1)}}},
+			},
+		},
+		{
+			name:   "only optional in quantifier is set",
+			query:  `items ANY (?sku = $sku)`,
+			params: []interface{}{"$sku", "x"},
+			want: &bson.D{
+				{Key: "items", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "sku", Value: "x"},
+				}}}},
+			},
+		},
+		{
+			name:  "field named optional",
+			query: `optional = true`,
+			want: &bson.D{
+				{Key: "optional", Value: true},
+			},
+		},
+		{
+			name:    "no parameters",
+			query:   `?a = 1`,
+			wantErr: true,
+		},
+		{
+			name:    "required parameter",
+			query:   `?a = $a and b = $b`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func printMarshalled(t *testing.T, marshalledQuery []byte) {
+	var q interface{}
+
+	err := bson.Unmarshal(marshalledQuery, &q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, _ := bson.MarshalExtJSONIndent(q, false, true, "", " ")
+	t.Log(string(j))
+}
+
+func TestCompileToBSON_Golden(t *testing.T) {
+	// outputs of previous (state machine) parser, queries compiled
+	// differently are marked
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: `a = 1 and b = 2 or c = 3`,
+			want:  `{"$or": [{"a": {"$numberInt":"1"},"b": {"$numberInt":"2"}},{"c": {"$numberInt":"3"}}]}`,
+		},
+		// previous parser dropped `b = 2`
+		{
+			query: `a = 1 or b = 2 and c = 3`,
+			want:  `{"$or": [{"a": {"$numberInt":"1"}},{"b": {"$numberInt":"2"},"c": {"$numberInt":"3"}}]}`,
+		},
+		// previous parser dropped `b = 2`
+		{
+			query: `a = 1 or b = 2 and c = 3 or d = 4`,
+			want:  `{"$or": [{"a": {"$numberInt":"1"}},{"b": {"$numberInt":"2"},"c": {"$numberInt":"3"}},{"d": {"$numberInt":"4"}}]}`,
+		},
+		{
+			query: `(a = 1 or b = 2) and c = 3`,
+			want:  `{"$or": [{"a": {"$numberInt":"1"}},{"b": {"$numberInt":"2"}}],"c": {"$numberInt":"3"}}`,
+		},
+		{
+			query: `a = 1 and (b = 2 or c = 3) and d = 4`,
+			want:  `{"a": {"$numberInt":"1"},"$or": [{"b": {"$numberInt":"2"}},{"c": {"$numberInt":"3"}}],"d": {"$numberInt":"4"}}`,
+		},
+		// previous parser wrote duplicate $or keys
+		{
+			query: `((a = 1 or b = 2) and (c = 3 or d = 4)) or e = 5`,
+			want:  `{"$or": [{"$and": [{"$or": [{"a": {"$numberInt":"1"}},{"b": {"$numberInt":"2"}}]},{"$or": [{"c": {"$numberInt":"3"}},{"d": {"$numberInt":"4"}}]}]},{"e": {"$numberInt":"5"}}]}`,
+		},
+		{
+			query: `not a = 1 and b = 2`,
+			want:  `{"a": {"$ne": {"$numberInt":"1"}},"b": {"$numberInt":"2"}}`,
+		},
+		{
+			query: `not (a = 1 and b = 2) or c = 3`,
+			want:  `{"$or": [{"$nor": [{"a": {"$numberInt":"1"},"b": {"$numberInt":"2"}}]},{"c": {"$numberInt":"3"}}]}`,
+		},
+		{
+			query: `a = 1 and not (b = 2 or c = 3)`,
+			want:  `{"a": {"$numberInt":"1"},"$nor": [{"b": {"$numberInt":"2"}},{"c": {"$numberInt":"3"}}]}`,
+		},
+		{
+			query: `!(a > 1 or b < 2) and not not c = 3`,
+			want:  `{"$nor": [{"a": {"$gt": {"$numberInt":"1"}}},{"b": {"$lt": {"$numberInt":"2"}}}],"c": {"$numberInt":"3"}}`,
+		},
+		{
+			query: `a > 1 and a < 5 and b = 2`,
+			want:  `{"a": {"$gt": {"$numberInt":"1"},"$lt": {"$numberInt":"5"}},"b": {"$numberInt":"2"}}`,
+		},
+		{
+			query: `a >= 1 and b = 1 and a <= 9 or a = 0`,
+			want:  `{"$or": [{"a": {"$gte": {"$numberInt":"1"},"$lte": {"$numberInt":"9"}},"b": {"$numberInt":"1"}},{"a": {"$numberInt":"0"}}]}`,
+		},
+		{
+			query: `5 < a and 10 >= b`,
+			want:  `{"a": {"$gt": {"$numberInt":"5"}},"b": {"$lte": {"$numberInt":"10"}}}`,
+		},
+		{
+			query: `1 < a <= 5 and b between 1 and 2`,
+			want:  `{"a": {"$gt": {"$numberInt":"1"},"$lte": {"$numberInt":"5"}},"b": {"$gte": {"$numberInt":"1"},"$lte": {"$numberInt":"2"}}}`,
+		},
+		// previous parser dropped `b = 2`
+		{
+			query: `items ANY (a = 1 or b = 2 and c = 3) and d = 4`,
+			want:  `{"items": {"$elemMatch": {"$or": [{"a": {"$numberInt":"1"}},{"b": {"$numberInt":"2"},"c": {"$numberInt":"3"}}]}},"d": {"$numberInt":"4"}}`,
+		},
+		{
+			query: `items ALL (qty > 0) or items NONE (price < 0)`,
+			want:  `{"$or": [{"items": {"$not": {"$elemMatch": {"$nor": [{"qty": {"$gt": {"$numberInt":"0"}}}]}}}},{"items": {"$not": {"$elemMatch": {"price": {"$lt": {"$numberInt":"0"}}}}}}]}`,
+		},
+		{
+			query: `price * qty > 1000 and strLen(name) > 5`,
+			want:  `{"$and": [{"$expr": {"$gt": [{"$multiply": ["$price","$qty"]},{"$numberInt":"1000"}]}},{"$expr": {"$gt": [{"$strLenCP": ["$name"]},{"$numberInt":"5"}]}}]}`,
+		},
+		{
+			query: `updatedAt > createdAt or a = b`,
+			want:  `{"$or": [{"$expr": {"$gt": ["$updatedAt","$createdAt"]}},{"$expr": {"$eq": ["$a","$b"]}}]}`,
+		},
+		{
+			query: `name like "abc%" and not email ilike "%@x.com"`,
+			want:  `{"name": {"$regularExpression":{"pattern":"^abc.*$","options":"s"}},"email": {"$not": {"$regularExpression":{"pattern":"^.*@x\\.com$","options":"is"}}}}`,
+		},
+		{
+			query: `a in [1, 2] and b not in [3] and c $exists true`,
+			want:  `{"a": {"$in": [{"$numberInt":"1"},{"$numberInt":"2"}]},"b": {"$nin": [{"$numberInt":"3"}]},"c": {"$exists": true}}`,
+		},
+		{
+			query: `?a = $a and b = 1`,
+			want:  `{"b": {"$numberInt":"1"}}`,
+		},
+		{
+			query: `tags $all ["a", "b"] and (x $size 2 or y $type "string")`,
+			want:  `{"tags": {"$all": ["a","b"]},"$or": [{"x": {"$size": {"$numberInt":"2"}}},{"y": {"$type": "string"}}]}`,
+		},
+		// previous parser dropped `e = 5`
+		{
+			query: `a = 1 and b = 2 and c = 3 and d = 4 or e = 5 and f = 6`,
+			want:  `{"$or": [{"a": {"$numberInt":"1"},"b": {"$numberInt":"2"},"c": {"$numberInt":"3"},"d": {"$numberInt":"4"}},{"e": {"$numberInt":"5"},"f": {"$numberInt":"6"}}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			cq, err := query.Compile(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := bson.Raw(mq).String(); got != tt.want {
+				t.Errorf("CompileToBSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncoder_ConcurrentEncode(t *testing.T) {
+	pq, err := query.Prepare(`a >= "$prm"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := [4]error{}
+
+	expNumBson := bson.D{
+		{Key: "a", Value: bson.D{{Key: "$gte", Value: 20}}},
+	}
+	expNumBytes, err := bson.Marshal(expNumBson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for {
+				if ctx.Err() != nil {
+					return
+				}
+
+				q, err := pq.Compile("$prm", 20)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+
+				qb, err := q.MarshalBSON()
+				if err != nil {
+					errs[i] = err
+					return
+				}
+
+				if !reflect.DeepEqual(qb, expNumBytes) {
+					errs[i] = fmt.Errorf("unexpected num bson")
+					return
+				}
+			}
+		}(i)
+	}
+
+	testDate := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	expTimeBson := bson.D{
+		{Key: "a", Value: bson.D{{Key: "$gte", Value: testDate}}},
+	}
+	expTimeBytes, err := bson.Marshal(expTimeBson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i < 4; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for {
+				if ctx.Err() != nil {
+					return
+				}
+
+				q, err := pq.Compile("$prm", testDate)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+
+				qb, err := q.MarshalBSON()
 				if err != nil {
 					errs[i] = err
 					return
 				}
 
-				qb, err := q.MarshalBSON()
-				if err != nil {
-					errs[i] = err
-					return
-				}
+				if !reflect.DeepEqual(qb, expTimeBytes) {
+					errs[i] = fmt.Errorf("unexpected time bson")
+					return
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(5 * time.Second)
+	cancel()
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPreparedQuery_Optional(t *testing.T) {
+	pq, err := query.Prepare(`?price >= $min and ?price < $max and price != 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// prepared query should not be changed by compilation
+	compiles := []struct {
+		params []interface{}
+		want   bson.D
+	}{
+		{
+			params: []interface{}{"$min", 1},
+			want:   bson.D{{Key: "price", Value: bson.D{{Key: "$gte", Value: 1}, {Key: "$ne", Value: int32(0)}}}},
+		},
+		{
+			params: []interface{}{"$max", 2},
+			want:   bson.D{{Key: "price", Value: bson.D{{Key: "$lt", Value: 2}, {Key: "$ne", Value: int32(0)}}}},
+		},
+		{
+			params: []interface{}{"$min", 1, "$max", 2},
+			want: bson.D{{Key: "price", Value: bson.D{
+				{Key: "$gte", Value: 1}, {Key: "$lt", Value: 2}, {Key: "$ne", Value: int32(0)},
+			}}},
+		},
+		{
+			want: bson.D{{Key: "price", Value: bson.D{{Key: "$ne", Value: int32(0)}}}},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, c := range compiles {
+			cq, err := pq.Compile(c.params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(c.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("Compile() = %s, want %s", bson.Raw(mq), bson.Raw(expectedQuery))
+			}
+		}
+	}
+}
+
+func TestPreparedQuery_Compose(t *testing.T) {
+	visible := query.MustPrepare(`owner = $user:string or public = true`)
+	price := query.MustPrepare(`price > $min:int`)
+	maxPrice := query.MustPrepare(`price < 100`)
+
+	tests := []struct {
+		name    string
+		compose func() (*query.PreparedQuery, error)
+		params  []interface{}
+		want    bson.D
+		wantErr bool
+	}{
+		{
+			name: "and",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.And(visible, price)
+			},
+			params: []interface{}{"$user", "bob", "$min", 5},
+			want: bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "owner", Value: "bob"}},
+					bson.D{{Key: "public", Value: true}},
+				}},
+				{Key: "price", Value: bson.D{{Key: "$gt", Value: int32(5)}}},
+			},
+		},
+		{
+			name: "linked across queries",
+			compose: func() (*query.PreparedQuery, error) {
+				return price.And(maxPrice)
+			},
+			params: []interface{}{"$min", 5},
+			want: bson.D{
+				{Key: "price", Value: bson.D{{Key: "$gt", Value: int32(5)}, {Key: "$lt", Value: int32(100)}}},
+			},
+		},
+		{
+			name: "or",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.Or(price, maxPrice)
+			},
+			params: []interface{}{"$min", 5},
+			want: bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "price", Value: bson.D{{Key: "$gt", Value: int32(5)}}}},
+					bson.D{{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(100)}}}},
+				}},
+			},
+		},
+		{
+			name: "or flattened",
+			compose: func() (*query.PreparedQuery, error) {
+				return visible.Or(maxPrice)
+			},
+			params: []interface{}{"$user", "bob"},
+			want: bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "owner", Value: "bob"}},
+					bson.D{{Key: "public", Value: true}},
+					bson.D{{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(100)}}}},
+				}},
+			},
+		},
+		{
+			name: "not",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.Not(price)
+			},
+			params: []interface{}{"$min", 5},
+			want: bson.D{
+				{Key: "price", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: int32(5)}}}}},
+			},
+		},
+		{
+			name: "double not",
+			compose: func() (*query.PreparedQuery, error) {
+				np, err := query.Not(visible)
+				if err != nil {
+					return nil, err
+				}
+
+				return query.Not(np)
+			},
+			params: []interface{}{"$user", "bob"},
+			want: bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "owner", Value: "bob"}},
+					bson.D{{Key: "public", Value: true}},
+				}},
+			},
+		},
+		{
+			name: "and not same field",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.MustPrepare(`a = 1`).And(query.MustPrepare(`not a = 2`))
+			},
+			want: bson.D{
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "a", Value: int32(1)}},
+					bson.D{{Key: "a", Value: bson.D{{Key: "$ne", Value: int32(2)}}}},
+				}},
+			},
+		},
+		{
+			name: "and empty",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.And(query.MustPrepare(``), maxPrice)
+			},
+			want: bson.D{
+				{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(100)}}},
+			},
+		},
+		{
+			name: "or empty",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.Or(query.MustPrepare(``), maxPrice)
+			},
+			want: bson.D{},
+		},
+		{
+			name: "not empty",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.Not(query.MustPrepare(``))
+			},
+			wantErr: true,
+		},
+		{
+			name: "optional",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.And(maxPrice, query.MustPrepare(`?price > $min`))
+			},
+			want: bson.D{
+				{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(100)}}},
+			},
+		},
+		{
+			name: "or optional",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.Or(query.MustPrepare(`?b = $b`), maxPrice)
+			},
+			want: bson.D{
+				{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(100)}}},
+			},
+		},
+		{
+			name: "redeclared",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.And(price, query.MustPrepare(`amount > $min:long`))
+			},
+			wantErr: true,
+		},
+		{
+			name: "text in or",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.Or(price, query.MustPrepare(`TEXT("coffee")`))
+			},
+			wantErr: true,
+		},
+		{
+			name: "different collations",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.And(
+					query.MustPrepare(`a = 1 COLLATE 'en' STRENGTH 2`),
+					query.MustPrepare(`b = 1 COLLATE 'fr'`),
+				)
+			},
+			wantErr: true,
+		},
+		{
+			name: "no queries",
+			compose: func() (*query.PreparedQuery, error) {
+				return query.And()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pq, err := tt.compose()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compose error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			cq, err := pq.Compile(tt.params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("Compile() = %s, want %s", bson.Raw(mq), bson.Raw(expectedQuery))
+			}
+		})
+	}
+
+	// composed queries should not be changed
+	cq, err := price.Compile("$min", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mq, err := cq.MarshalBSON()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-				if !reflect.DeepEqual(qb, expTimeBytes) {
-					errs[i] = fmt.Errorf("unexpected time bson")
-					return
-				}
-			}
-		}(i)
+	expectedQuery, err := bson.Marshal(bson.D{{Key: "price", Value: bson.D{{Key: "$gt", Value: int32(5)}}}})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	time.Sleep(5 * time.Second)
-	cancel()
+	if !reflect.DeepEqual(expectedQuery, mq) {
+		t.Errorf("Compile() = %s, want %s", bson.Raw(mq), bson.Raw(expectedQuery))
+	}
+}
 
-	wg.Wait()
+func TestPreparedQuery_ComposeEquivalence(t *testing.T) {
+	// composed query should be the same as query joined in text
+	tests := []struct {
+		name string
+		op   string
+		l, r string
+	}{
+		{name: "same field", op: "and", l: `a = 1`, r: `a > 0`},
+		{name: "linked ranges", op: "and", l: `a > 1 and a < 5`, r: `a != 3 and b = 1`},
+		{name: "negated same field", op: "and", l: `a = 1`, r: `not a = 2`},
+		{name: "two nor", op: "and", l: `not (a = 1 or b = 1)`, r: `not (c = 1 or d = 1)`},
+		{name: "two or", op: "and", l: `a = 1 or b = 1`, r: `c = 1 or d = 1`},
+		{name: "two expr", op: "and", l: `a > b`, r: `not c > d`},
+		{name: "or of and", op: "or", l: `a = 1 or b = 1`, r: `c = 1 and d = 1`},
+		{name: "or optional", op: "or", l: `?b = $b`, r: `a = 1`},
+	}
 
-	for _, err := range errs {
-		if err != nil {
-			t.Fatal(err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, r := query.MustPrepare(tt.l), query.MustPrepare(tt.r)
+
+			var pq *query.PreparedQuery
+			var err error
+
+			if tt.op == "and" {
+				pq, err = query.And(l, r)
+			} else {
+				pq, err = query.Or(l, r)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cq, err := pq.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text := "(" + tt.l + ") " + tt.op + " (" + tt.r + ")"
+
+			tq, err := query.Compile(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := tq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("Compile() = %s, want %s (%s)", bson.Raw(mq), bson.Raw(expectedQuery), text)
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Macros(t *testing.T) {
+	defines := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{name: "testActive", query: `status = "active" AND deletedAt $exists false`},
+		{name: "testOwned", query: `owner = $user:string`},
+		{name: "testVisible", query: `@testOwned or public = true`},
+		{name: "testLoopA", query: `a = 1`},
+		{name: "testLoopB", query: `@testLoopA`},
+		{name: "testLoopA", query: `@testLoopB`, wantErr: true},
+		{name: "testActive", query: `status = "active" AND deletedAt $exists false`},
+		{name: "testActive", query: `status = "active"`, wantErr: true},
+		{name: "testUndefined", query: `@testNope`, wantErr: true},
+		{name: "testInvalid", query: `a = `, wantErr: true},
+		{name: "test.dot", query: `a = 1`, wantErr: true},
+	}
+
+	for _, d := range defines {
+		err := query.Define(d.name, d.query)
+		if (err != nil) != d.wantErr {
+			t.Fatalf("Define(%s) error = %v, wantErr %v", d.name, err, d.wantErr)
 		}
 	}
+
+	tests := []struct {
+		name    string
+		query   string
+		params  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:  "defined",
+			query: `@testActive and price < 10`,
+			want: &bson.D{
+				{Key: "status", Value: "active"},
+				{Key: "deletedAt", Value: bson.D{{Key: "$exists", Value: false}}},
+				{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(10)}}},
+			},
+		},
+		{
+			name:   "nested with parameter",
+			query:  `@testVisible and @testActive`,
+			params: []interface{}{"$user", "bob"},
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "owner", Value: "bob"}},
+					bson.D{{Key: "public", Value: true}},
+				}},
+				{Key: "status", Value: "active"},
+				{Key: "deletedAt", Value: bson.D{{Key: "$exists", Value: false}}},
+			},
+		},
+		{
+			name:  "negated",
+			query: `not @testActive`,
+			want: &bson.D{
+				{Key: "$nor", Value: bson.A{
+					bson.D{
+						{Key: "status", Value: "active"},
+						{Key: "deletedAt", Value: bson.D{{Key: "$exists", Value: false}}},
+					},
+				}},
+			},
+		},
+		{
+			name:  "let",
+			query: `LET cheap = (price < 10) LET good = (rating >= 4) @cheap and @good`,
+			want: &bson.D{
+				{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(10)}}},
+				{Key: "rating", Value: bson.D{{Key: "$gte", Value: int32(4)}}},
+			},
+		},
+		{
+			name:  "let uses let",
+			query: `let cheap = (price < 10) let best = (@cheap and rating = 5) @best or @cheap`,
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{
+						{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(10)}}},
+						{Key: "rating", Value: int32(5)},
+					},
+					bson.D{{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(10)}}}},
+				}},
+			},
+		},
+		{
+			name:  "let hides defined",
+			query: `LET testActive = (active = true) @testActive`,
+			want:  &bson.D{{Key: "active", Value: true}},
+		},
+		{
+			name:   "let with parameter",
+			query:  `LET recent = (created > $since:date) @recent and type = 1`,
+			params: []interface{}{"$since", time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+			want: &bson.D{
+				{Key: "created", Value: bson.D{{Key: "$gt", Value: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}}},
+				{Key: "type", Value: int32(1)},
+			},
+		},
+		{
+			name:   "bound parameters",
+			query:  `LET cheap = (price < $max:int) @cheap($max = 10) or @cheap($max = $limit)`,
+			params: []interface{}{"$limit", 20},
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(10)}}}},
+					bson.D{{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(20)}}}},
+				}},
+			},
+		},
+		{
+			name:   "defined with bound parameter",
+			query:  `@testOwned($user = "bob") or @testOwned($user = $other)`,
+			params: []interface{}{"$other", "alice"},
+			want: &bson.D{
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "owner", Value: "bob"}},
+					bson.D{{Key: "owner", Value: "alice"}},
+				}},
+			},
+		},
+		{
+			name:  "nested bound parameters",
+			query: `LET c = (a = $x and b in $y) LET d = (@c($x = $z, $y = [1, 2])) @d($z = "q")`,
+			want: &bson.D{
+				{Key: "a", Value: "q"},
+				{Key: "b", Value: bson.D{{Key: "$in", Value: bson.A{int32(1), int32(2)}}}},
+			},
+		},
+		{
+			name:  "bound parameters with defaults",
+			query: `LET c = (price < $max:int = 5 and id in $ids:[long] = [1]) @c($max = 100, $ids = [2, 3])`,
+			want: &bson.D{
+				{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(100)}}},
+				{Key: "id", Value: bson.D{{Key: "$in", Value: bson.A{int64(2), int64(3)}}}},
+			},
+		},
+		{
+			name:  "bound parameter converted",
+			query: `LET c = (created > $since:date and $min:long < qty) @c($since = "2022-01-01", $min = 5)`,
+			want: &bson.D{
+				{Key: "created", Value: bson.D{{Key: "$gt", Value: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}}},
+				{Key: "qty", Value: bson.D{{Key: "$gt", Value: int64(5)}}},
+			},
+		},
+		{
+			name:    "bound parameter of other type",
+			query:   `LET c = (price < $max:int) @c($max = "abc")`,
+			wantErr: true,
+		},
+		{
+			name:    "bound array of other type",
+			query:   `LET c = (id in $ids:[int]) @c($ids = ["a"])`,
+			wantErr: true,
+		},
+		{
+			name:    "bound parameter is not literal",
+			query:   `LET c = (price < $max:int) @c($max = 1 + 2)`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown bound parameter",
+			query:   `LET c = (a < $max) @c($min = 1)`,
+			wantErr: true,
+		},
+		{
+			name:    "parameter bound twice",
+			query:   `LET c = (a < $max) @c($max = 1, $max = 2)`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid binding",
+			query:   `LET c = (a < $max) @c(max = 1)`,
+			wantErr: true,
+		},
+		{
+			name:    "bindings not closed",
+			query:   `LET c = (a < $max) @c($max = 1`,
+			wantErr: true,
+		},
+		{
+			name:  "let is field",
+			query: `let = 5`,
+			want:  &bson.D{{Key: "let", Value: int32(5)}},
+		},
+		{
+			name:    "cycle",
+			query:   `LET a = (@b) LET b = (x = 1 or @a) @a`,
+			wantErr: true,
+		},
+		{
+			name:    "self reference",
+			query:   `LET a = (x = 1 and @a) @a`,
+			wantErr: true,
+		},
+		{
+			name:    "not defined",
+			query:   `@nope`,
+			wantErr: true,
+		},
+		{
+			name:    "redefined",
+			query:   `LET a = (x = 1) LET a = (y = 1) @a`,
+			wantErr: true,
+		},
+		{
+			name:    "parameter redeclared",
+			query:   `@testOwned and creator = $user:int`,
+			params:  []interface{}{"$user", 1},
+			wantErr: true,
+		},
+		{
+			name:    "let after query",
+			query:   `a = 1 LET b = (b = 1)`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+		})
+	}
+}
+
+func TestCompileToBSON_Collation(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		params        []interface{}
+		want          interface{}
+		wantCollation *options.Collation
+		wantErr       bool
+	}{
+		{
+			name:  "ignore case without collation",
+			query: `email =~ "Bob@Example.com"`,
+			want: &bson.D{
+				{Key: "email", Value: primitive.Regex{Pattern: `^Bob@Example\.com$`, Options: "i"}},
+			},
+		},
+		{
+			name:   "equals ignore case",
+			query:  `email EQUALS IGNORE CASE $email and not name equals ignore case "a+b"`,
+			params: []interface{}{"$email", "x@y.z"},
+			want: &bson.D{
+				{Key: "email", Value: primitive.Regex{Pattern: `^x@y\.z$`, Options: "i"}},
+				{Key: "name", Value: bson.D{{Key: "$not", Value: primitive.Regex{Pattern: `^a\+b$`, Options: "i"}}}},
+			},
+		},
+		{
+			name:          "ignore case with collation",
+			query:         `email =~ $email COLLATE 'en' STRENGTH 2`,
+			params:        []interface{}{"$email", "Bob@Example.com"},
+			want:          &bson.D{{Key: "email", Value: "Bob@Example.com"}},
+			wantCollation: &options.Collation{Locale: "en", Strength: 2},
+		},
+		{
+			name:          "negated with collation",
+			query:         `not email =~ "bob" COLLATE "fr" STRENGTH 1 BACKWARDS`,
+			want:          &bson.D{{Key: "email", Value: bson.D{{Key: "$ne", Value: "bob"}}}},
+			wantCollation: &options.Collation{Locale: "fr", Strength: 1, Backwards: true},
+		},
+		{
+			name:  "case sensitive collation",
+			query: `email =~ "bob" and a = 1 COLLATE 'en' CASE_LEVEL CASE_FIRST 'upper' NUMERIC_ORDERING ALTERNATE 'shifted' MAX_VARIABLE 'space' NORMALIZATION`,
+			want: &bson.D{
+				{Key: "email", Value: primitive.Regex{Pattern: `^bob$`, Options: "i"}},
+				{Key: "a", Value: int32(1)},
+			},
+			wantCollation: &options.Collation{
+				Locale:          "en",
+				CaseLevel:       true,
+				CaseFirst:       "upper",
+				NumericOrdering: true,
+				Alternate:       "shifted",
+				MaxVariable:     "space",
+				Normalization:   true,
+			},
+		},
+		{
+			name:          "only collation",
+			query:         `COLLATE 'en'`,
+			want:          &bson.D{},
+			wantCollation: &options.Collation{Locale: "en"},
+		},
+		{
+			name:  "collate field",
+			query: `collate = 1`,
+			want:  &bson.D{{Key: "collate", Value: int32(1)}},
+		},
+		{
+			name:    "ignore case of number",
+			query:   `a =~ 1`,
+			wantErr: true,
+		},
+		{
+			name:    "equals without ignore case",
+			query:   `a equals "x"`,
+			wantErr: true,
+		},
+		{
+			name:    "collate in block",
+			query:   `a = 1 and (b = 2 COLLATE 'en')`,
+			wantErr: true,
+		},
+		{
+			name:    "collate not at end",
+			query:   `a = 1 COLLATE 'en' and b = 2`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong strength",
+			query:   `a = 1 COLLATE 'en' STRENGTH 0`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong case first",
+			query:   `a = 1 COLLATE 'en' CASE_FIRST 'first'`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := query.Compile(tt.query, tt.params...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			mq, err := cq.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQuery, err := bson.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			printMarshalled(t, mq)
+
+			if !reflect.DeepEqual(expectedQuery, mq) {
+				t.Errorf("CompileToBSON() = %s, want %s",
+					bson.Raw(mq),
+					bson.Raw(expectedQuery))
+			}
+
+			if !reflect.DeepEqual(cq.Collation(), tt.wantCollation) {
+				t.Errorf("Collation() = %+v, want %+v", cq.Collation(), tt.wantCollation)
+			}
+		})
+	}
 }
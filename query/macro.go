@@ -0,0 +1,479 @@
+package query
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+var keyLet = []byte("let")
+
+// macroToken is a token of macro body.
+type macroToken struct {
+	t Token
+	l []byte
+}
+
+var (
+	macrosMu sync.RWMutex
+	// macros are named query fragments registered with Define.
+	macros = map[string][]macroToken{}
+)
+
+// Define registers named query fragment, queries prepared after it
+// can reference fragment as `@name`. Parameters declared in fragment
+// become parameters of queries that use it, unless they are bound
+// in reference like `@name($max = 10)`. Fragment can not be redefined
+// with other query.
+func Define(name, query string) error {
+	if !isMacroNameLit([]byte(name)) {
+		return fmt.Errorf("invalid macro name %q", name)
+	}
+
+	body, err := readMacroBody(NewScanner(strings.NewReader(query)))
+	if err != nil {
+		return fmt.Errorf("macro %s: %w", name, err)
+	}
+
+	// check that fragment can be parsed, it is parsed as a reference
+	// to local macro, so it can not use LET
+	p := NewParser(NewScanner(strings.NewReader("@" + name)))
+	p.macros = map[string][]macroToken{name: body}
+
+	_, err = p.Parse()
+	if err != nil {
+		return fmt.Errorf("macro %s: %w", name, err)
+	}
+
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+
+	if prev, ok := macros[name]; ok && !sameTokens(prev, body) {
+		return fmt.Errorf("macro %s is already defined", name)
+	}
+
+	macros[name] = body
+
+	return nil
+}
+
+func sameTokens(a, b []macroToken) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].t != b[i].t || !bytes.Equal(a[i].l, b[i].l) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readMacroBody reads all tokens of scanner, macro references are
+// kept as is and expanded when macro is used.
+func readMacroBody(s *Scanner) ([]macroToken, error) {
+	var body []macroToken
+
+	for {
+		err := s.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return body, nil
+			}
+
+			return nil, err
+		}
+
+		t, l := s.Token()
+		body = append(body, macroToken{t: t, l: []byte(string(l))})
+	}
+}
+
+// parseLets parses definitions `LET name = (...)` at the beginning
+// of query, definitions are visible in the whole query and hide
+// fragments registered with Define.
+func (p *Parser) parseLets() error {
+	for {
+		t, l, err := p.rawToken()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		read := []macroToken{{t: t, l: []byte(string(l))}}
+
+		if t != TKey || !bytes.EqualFold(l, keyLet) {
+			p.queue = append(read, p.queue...)
+			return nil
+		}
+
+		// LET is a definition only if followed by `name = (`,
+		// otherwise it is a field name
+		for _, next := range []func(Token, []byte) bool{
+			func(t Token, l []byte) bool { return t == TKey && isMacroNameLit(l) },
+			func(t Token, l []byte) bool { return t == TOp && string(l) == "=" },
+			func(t Token, l []byte) bool { return t == TParentheses && l[0] == '(' },
+		} {
+			t, l, err = p.rawToken()
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+
+			if err != nil || !next(t, l) {
+				if err == nil {
+					read = append(read, macroToken{t: t, l: []byte(string(l))})
+				}
+
+				p.queue = append(read, p.queue...)
+				return nil
+			}
+
+			read = append(read, macroToken{t: t, l: []byte(string(l))})
+		}
+
+		name := string(read[1].l)
+
+		body, err := p.readLetBody()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := p.macros[name]; ok {
+			return p.positionError(fmt.Sprintf("macro %s redefined", name))
+		}
+
+		if p.macros == nil {
+			p.macros = make(map[string][]macroToken)
+		}
+
+		p.macros[name] = body
+	}
+}
+
+// readLetBody reads tokens until closing parenthesis of LET definition,
+// opening parenthesis should be read already.
+func (p *Parser) readLetBody() ([]macroToken, error) {
+	var body []macroToken
+
+	depth := 0
+
+	for {
+		t, l, err := p.rawToken()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, p.positionError("unexpected end of LET (expected ')')")
+			}
+
+			return nil, err
+		}
+
+		if t == TParentheses {
+			switch l[0] {
+			case '(':
+				depth++
+			case ')':
+				if depth == 0 {
+					if len(body) == 0 {
+						return nil, p.positionError("empty LET")
+					}
+
+					return body, nil
+				}
+
+				depth--
+			}
+		}
+
+		body = append(body, macroToken{t: t, l: []byte(string(l))})
+	}
+}
+
+// expandMacro returns tokens of macro body enclosed in parentheses
+// with all nested references expanded and parameters replaced with
+// bound values of args, used are names of macros being expanded.
+func (p *Parser) expandMacro(name string, args []macroToken, used []string) ([]macroToken, error) {
+	if name == "" {
+		return nil, p.positionError("macro name expected after @")
+	}
+
+	for i, u := range used {
+		if u == name {
+			chain := "@" + strings.Join(append(used[i:], name), " -> @")
+			return nil, p.positionError(fmt.Sprintf("macro cycle %s", chain))
+		}
+	}
+
+	body, ok := p.macros[name]
+	if !ok {
+		macrosMu.RLock()
+		body, ok = macros[name]
+		macrosMu.RUnlock()
+	}
+
+	if !ok {
+		return nil, p.positionError(fmt.Sprintf("macro @%s is not defined", name))
+	}
+
+	binds, err := p.macroBindings(name, args)
+	if err != nil {
+		return nil, err
+	}
+
+	used = append(used[:len(used):len(used)], name)
+
+	tokens := []macroToken{{t: TParentheses, l: []byte("(")}}
+
+	for i := 0; i < len(body); i++ {
+		mt := body[i]
+		if mt.t != TMacro {
+			tokens = append(tokens, mt)
+			continue
+		}
+
+		var nestedArgs []macroToken
+		if i+1 < len(body) && body[i+1].t == TParentheses && body[i+1].l[0] == '(' {
+			nestedArgs, i = macroArgsOf(body, i+1)
+		}
+
+		nested, err := p.expandMacro(string(mt.l), nestedArgs, used)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, nested...)
+	}
+
+	tokens = append(tokens, macroToken{t: TParentheses, l: []byte(")")})
+
+	return p.bindMacroParams(name, tokens, binds)
+}
+
+// macroArgsOf returns tokens of macro arguments that start with
+// parenthesis at body[start] and index of closing parenthesis.
+func macroArgsOf(body []macroToken, start int) ([]macroToken, int) {
+	depth := 0
+
+	for i := start; i < len(body); i++ {
+		if body[i].t != TParentheses {
+			continue
+		}
+
+		switch body[i].l[0] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return body[start : i+1], i
+			}
+		}
+	}
+
+	return body[start:], len(body)
+}
+
+// readMacroArgs reads arguments `($a = 1, $b = $c)` which follow
+// macro reference.
+func (p *Parser) readMacroArgs() ([]macroToken, error) {
+	t, l, err := p.rawToken()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	args := []macroToken{{t: t, l: []byte(string(l))}}
+
+	if t != TParentheses || l[0] != '(' {
+		p.queue = append(args, p.queue...)
+		return nil, nil
+	}
+
+	depth := 1
+
+	for depth > 0 {
+		t, l, err = p.rawToken()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, p.positionError("unexpected end of macro arguments (expected ')')")
+			}
+
+			return nil, err
+		}
+
+		if t == TParentheses {
+			switch l[0] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+		}
+
+		args = append(args, macroToken{t: t, l: []byte(string(l))})
+	}
+
+	return args, nil
+}
+
+// macroBindings parses arguments of macro reference (with parentheses)
+// like `($max = 10, $min = $low)` to values bound to parameters.
+func (p *Parser) macroBindings(name string, args []macroToken) (map[string][]macroToken, error) {
+	if len(args) <= 2 {
+		return nil, nil
+	}
+
+	binds := map[string][]macroToken{}
+
+	bind := func(arg []macroToken) error {
+		if len(arg) < 3 ||
+			arg[0].t != TKey ||
+			!isParamLit(arg[0].l) ||
+			arg[1].t != TOp ||
+			string(arg[1].l) != "=" {
+			return p.positionError(fmt.Sprintf("invalid argument of macro @%s (expected $param = value)", name))
+		}
+
+		prm := string(arg[0].l)
+		if _, ok := binds[prm]; ok {
+			return p.positionError(fmt.Sprintf("parameter %s of macro @%s is bound twice", prm, name))
+		}
+
+		binds[prm] = arg[2:]
+
+		return nil
+	}
+
+	start, depth := 1, 0
+
+	for i, mt := range args[1 : len(args)-1] {
+		switch {
+		case mt.t == TParentheses && strings.IndexByte("([{", mt.l[0]) >= 0:
+			depth++
+		case mt.t == TParentheses:
+			depth--
+		case mt.t == TComma && depth == 0:
+			err := bind(args[start : i+1])
+			if err != nil {
+				return nil, err
+			}
+
+			start = i + 2
+		}
+	}
+
+	err := bind(args[start : len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	return binds, nil
+}
+
+// boundParam is a declared parameter of macro bound to literal.
+type boundParam struct {
+	name  string
+	value []macroToken
+}
+
+// bindMacroParams replaces parameters of expanded macro with bound values.
+// Declared parameter (`$max:int = 5`) bound to literal is replaced with
+// internal name, so parser reads declaration and checks literal against
+// it (see parseParam).
+func (p *Parser) bindMacroParams(
+	name string,
+	tokens []macroToken,
+	binds map[string][]macroToken,
+) ([]macroToken, error) {
+	if len(binds) == 0 {
+		return tokens, nil
+	}
+
+	bound := make([]macroToken, 0, len(tokens))
+	unused := make(map[string]bool, len(binds))
+
+	for prm := range binds {
+		unused[prm] = true
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		mt := tokens[i]
+
+		v, ok := binds[string(mt.l)]
+		if mt.t != TKey || !ok {
+			bound = append(bound, mt)
+			continue
+		}
+
+		delete(unused, string(mt.l))
+
+		declared := i+1 < len(tokens) && tokens[i+1].t == TColon
+		if !declared || len(v) == 1 && v[0].t == TKey && isParamLit(v[0].l) {
+			bound = append(bound, v...)
+			continue
+		}
+
+		if p.bound == nil {
+			p.bound = make(map[string]boundParam)
+		}
+
+		// `@` can not be a part of parameter name in text
+		in := fmt.Sprintf("%s@%d", mt.l, len(p.bound))
+		p.bound[in] = boundParam{name: string(mt.l), value: v}
+
+		bound = append(bound, macroToken{t: TKey, l: []byte(in)})
+	}
+
+	for prm := range unused {
+		return nil, p.positionError(fmt.Sprintf("macro @%s has no parameter %s", name, prm))
+	}
+
+	return bound, nil
+}
+
+func isParamLit(l []byte) bool {
+	return len(l) > 1 && l[0] == '$' && l[1] != '$'
+}
+
+// rawToken returns token of expanded macro or reads next one,
+// macro references are not expanded.
+func (p *Parser) rawToken() (Token, []byte, error) {
+	if len(p.queue) > 0 {
+		mt := p.queue[0]
+		p.queue = p.queue[1:]
+
+		return mt.t, mt.l, nil
+	}
+
+	err := p.s.Next()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	t, l := p.s.Token()
+	return t, l, nil
+}
+
+func isMacroNameLit(l []byte) bool {
+	if len(l) == 0 {
+		return false
+	}
+
+	for _, c := range l {
+		if !isMacroName(c) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,400 @@
+package query
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Param is a typed parameter declaration like `$start:date`,
+// `$ids:[objectId]` or `$limit:int = 10`.
+type Param struct {
+	Name string
+	// Type is one of paramTypes.
+	Type string
+	// Array is true for array types like `[objectId]`.
+	Array bool
+	// Default is used when parameter is not passed to Compile,
+	// it is already converted to parameter type.
+	Default    interface{}
+	HasDefault bool
+	// loc is a time zone of date strings without offset.
+	loc *time.Location
+}
+
+func (prm Param) String() string {
+	if prm.Array {
+		return "[" + prm.Type + "]"
+	}
+
+	return prm.Type
+}
+
+// same reports whether declarations have the same type and default.
+func (prm Param) same(other Param) bool {
+	return prm.String() == other.String() &&
+		prm.HasDefault == other.HasDefault &&
+		reflect.DeepEqual(prm.Default, other.Default)
+}
+
+// paramTypes are supported parameter types and
+// converters of Go values to them.
+var paramTypes = map[string]func(v interface{}) (interface{}, bool){
+	"int":      convertInt32,
+	"long":     convertInt64,
+	"double":   convertDouble,
+	"decimal":  convertDecimal,
+	"string":   convertString,
+	"bool":     convertBool,
+	"date":     convertDate,
+	"duration": convertDuration,
+	"objectId": convertObjectID,
+}
+
+// Convert checks that v has compatible type and converts it to
+// the value of declared type.
+func (prm Param) Convert(v interface{}) (interface{}, error) {
+	if !prm.Array {
+		cv, ok := prm.convert(v)
+		if !ok {
+			return nil, fmt.Errorf("parameter %s must be %s, got %T", prm.Name, prm, v)
+		}
+
+		return cv, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Array &&
+		(rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8) {
+		return nil, fmt.Errorf("parameter %s must be %s, got %T", prm.Name, prm, v)
+	}
+
+	arr := make(bson.A, rv.Len())
+
+	for i := range arr {
+		ev := rv.Index(i).Interface()
+
+		cv, ok := prm.convert(ev)
+		if !ok {
+			return nil, fmt.Errorf("parameter %s must be %s, got %T at index %d", prm.Name, prm, ev, i)
+		}
+
+		arr[i] = cv
+	}
+
+	return arr, nil
+}
+
+// convert converts single value to declared type, date strings
+// are parsed as ISODate literals.
+func (prm Param) convert(v interface{}) (interface{}, bool) {
+	if s, ok := v.(string); ok && prm.Type == "date" {
+		loc := prm.loc
+		if loc == nil {
+			loc = DefaultLocation
+		}
+
+		t, err := parseDate(s, loc)
+		if err != nil {
+			return nil, false
+		}
+
+		return t, true
+	}
+
+	return paramTypes[prm.Type](v)
+}
+
+// Omit is a parameter value that removes optional clauses
+// with the parameter (same as missing parameter or nil).
+var Omit = omitParam{}
+
+type omitParam struct{}
+
+// omittedParam reports whether parameter is missing (and has no default),
+// nil or Omit.
+func omittedParam(params map[string]Param, prmMap map[string]interface{}, name string) bool {
+	v, ok := prmMap[name]
+	if !ok {
+		return !params[name].HasDefault
+	}
+
+	return v == nil || v == Omit
+}
+
+// applyParams converts passed parameters to declared types and
+// sets defaults of missing ones. Omitted parameters of optional
+// clauses are skipped.
+func applyParams(
+	params map[string]Param,
+	optional map[string]bool,
+	prmMap map[string]interface{},
+) (map[string]interface{}, error) {
+	if len(params) == 0 {
+		return prmMap, nil
+	}
+
+	if prmMap == nil {
+		prmMap = make(map[string]interface{}, len(params))
+	}
+
+	for name, prm := range params {
+		if optional[name] && omittedParam(params, prmMap, name) {
+			continue
+		}
+
+		v, ok := prmMap[name]
+		if !ok {
+			if !prm.HasDefault {
+				return nil, fmt.Errorf("parameter %s is not set", name)
+			}
+
+			prmMap[name] = prm.Default
+			continue
+		}
+
+		cv, err := prm.Convert(v)
+		if err != nil {
+			return nil, err
+		}
+
+		prmMap[name] = cv
+	}
+
+	return prmMap, nil
+}
+
+func convertInt32(v interface{}) (interface{}, bool) {
+	i, ok := integerValue(v)
+	if !ok || i < math.MinInt32 || i > math.MaxInt32 {
+		return nil, false
+	}
+
+	return int32(i), true
+}
+
+func convertInt64(v interface{}) (interface{}, bool) {
+	return integerValue(v)
+}
+
+func integerValue(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := rv.Uint()
+		if u > math.MaxInt64 {
+			return 0, false
+		}
+
+		return int64(u), true
+	}
+
+	return 0, false
+}
+
+func convertDouble(v interface{}) (interface{}, bool) {
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+
+	i, ok := integerValue(v)
+	if !ok {
+		return nil, false
+	}
+
+	return float64(i), true
+}
+
+func convertDecimal(v interface{}) (interface{}, bool) {
+	switch tv := v.(type) {
+	case primitive.Decimal128:
+		return tv, true
+	case string:
+		d, err := primitive.ParseDecimal128(tv)
+		if err != nil {
+			return nil, false
+		}
+
+		return d, true
+	}
+
+	i, ok := integerValue(v)
+	if !ok {
+		return nil, false
+	}
+
+	d, err := primitive.ParseDecimal128(strconv.FormatInt(i, 10))
+	return d, err == nil
+}
+
+func convertString(v interface{}) (interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.String {
+		return nil, false
+	}
+
+	return rv.String(), true
+}
+
+func convertBool(v interface{}) (interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Bool {
+		return nil, false
+	}
+
+	return rv.Bool(), true
+}
+
+func convertDate(v interface{}) (interface{}, bool) {
+	switch tv := v.(type) {
+	case time.Time:
+		return tv, true
+	case *time.Time:
+		if tv == nil {
+			return nil, false
+		}
+
+		return *tv, true
+	case primitive.DateTime:
+		return tv, true
+	}
+
+	return nil, false
+}
+
+func convertDuration(v interface{}) (interface{}, bool) {
+	switch tv := v.(type) {
+	case time.Duration:
+		return tv, true
+	case string:
+		d, err := parseDuration(tv)
+		if err != nil {
+			return nil, false
+		}
+
+		return d, true
+	}
+
+	return nil, false
+}
+
+func convertObjectID(v interface{}) (interface{}, bool) {
+	switch tv := v.(type) {
+	case primitive.ObjectID:
+		return tv, true
+	case string:
+		oid, err := primitive.ObjectIDFromHex(tv)
+		if err != nil {
+			return nil, false
+		}
+
+		return oid, true
+	}
+
+	return nil, false
+}
+
+// literalValue returns Go value of parsed literal.
+func literalValue(v []byte, vt ValueType) (interface{}, error) {
+	switch vt {
+	case VTString:
+		return string(v[1 : len(v)-1]), nil
+	case VTInteger:
+		return int64(binary.BigEndian.Uint64(v)), nil
+	case VTFloat:
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), nil
+	case VTBool:
+		return v[0] == 1, nil
+	case VTDate:
+		return primitive.DateTime(binary.BigEndian.Uint64(v)), nil
+	case VTObjectID:
+		var oid primitive.ObjectID
+		copy(oid[:], v)
+		return oid, nil
+	case VTNull:
+		return nil, nil
+	case VTDecimal:
+		return primitive.NewDecimal128(binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:])), nil
+	case VTInt32:
+		return int32(binary.BigEndian.Uint32(v)), nil
+	case VTInt64:
+		return int64(binary.BigEndian.Uint64(v)), nil
+	case VTUUID:
+		return primitive.Binary{Subtype: bsontype.BinaryUUID, Data: v}, nil
+	case VTBinary:
+		return primitive.Binary{Subtype: v[0], Data: v[1:]}, nil
+	case VTTimestamp:
+		return primitive.Timestamp{T: binary.BigEndian.Uint32(v), I: binary.BigEndian.Uint32(v[4:])}, nil
+	case VTDuration:
+		return time.Duration(binary.BigEndian.Uint64(v)), nil
+	case VTMinKey:
+		return primitive.MinKey{}, nil
+	case VTMaxKey:
+		return primitive.MaxKey{}, nil
+	case VTArray:
+		c := binary.BigEndian.Uint32(v)
+		v = v[4:]
+
+		arr := make(bson.A, c)
+
+		for i := range arr {
+			evt := ValueType(v[0])
+			v = v[1:]
+
+			var tl uint32
+			tl, v = tokenLength(evt, v)
+
+			ev, err := literalValue(v[:tl], evt)
+			if err != nil {
+				return nil, err
+			}
+
+			arr[i] = ev
+			v = v[tl:]
+		}
+
+		return arr, nil
+	case VTDocument:
+		c := binary.BigEndian.Uint32(v)
+		v = v[4:]
+
+		doc := make(bson.D, c)
+
+		for i := range doc {
+			kl := binary.BigEndian.Uint32(v)
+			doc[i].Key = string(v[4 : 4+kl])
+			v = v[4+kl:]
+
+			evt := ValueType(v[0])
+			v = v[1:]
+
+			var tl uint32
+			tl, v = tokenLength(evt, v)
+
+			ev, err := literalValue(v[:tl], evt)
+			if err != nil {
+				return nil, err
+			}
+
+			doc[i].Value = ev
+			v = v[tl:]
+		}
+
+		return doc, nil
+	}
+
+	return nil, fmt.Errorf("value can not be used as default")
+}
@@ -2,328 +2,2966 @@ package query
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
 	keyOr           = []byte("or")
 	keyAnd          = []byte("and")
+	keyNot          = []byte("not")
+	keyAny          = []byte("any")
+	keyAll          = []byte("all")
+	keyNone         = []byte("none")
+	keyBetween      = []byte("between")
+	keyIn           = []byte("in")
+	keySphere       = []byte("sphere")
+	keyFuncText     = []byte("text")
+	keyFuncJSON     = []byte("JSON")
+	keyOptional     = []byte("optional")
+	keyCollate      = []byte("collate")
+	keyEquals       = []byte("equals")
 	keyFuncDate     = []byte("ISODate")
 	keyFuncObjectID = []byte("ObjectId")
+	keyNull         = []byte("null")
 )
 
+// DefaultLocation is a time zone of dates without offset (like
+// `ISODate("2022-01-15")`) and calendar periods without zone.
+// It is used by parsers created after it is changed, use WithLocation
+// option of Prepare to set time zone of single query.
+var DefaultLocation = time.UTC
+
 var ErrParsed = errors.New("text parsed")
 
 func NewParser(s *Scanner) *Parser {
 	return &Parser{
-		s: s,
+		s:   s,
+		loc: DefaultLocation,
+	}
+}
+
+type Parser struct {
+	s *Scanner
+	// block is true while parsing nested block (like `(...)` or `ANY (...)`).
+	block bool
+	// token returned back to parser.
+	backTok Token
+	backLit []byte
+	// params are typed parameter declarations.
+	params map[string]Param
+	// loc is a time zone of dates without offset.
+	loc *time.Location
+	// left is true while left operand of expression is parsed.
+	left bool
+	// used are parameters of optional clause being parsed.
+	used map[string]bool
+	// macros are fragments defined with LET.
+	macros map[string][]macroToken
+	// queue are tokens of expanded macros, they are read
+	// before the rest of text.
+	queue []macroToken
+	// bound are declared parameters of macros bound to literals
+	// in macro reference, declaration is parsed as usual but
+	// literal is used instead of parameter.
+	bound map[string]boundParam
+	// collation is set by COLLATE clause.
+	collation *options.Collation
+}
+
+// SetLocation sets time zone of dates without offset and
+// calendar periods without zone.
+func (p *Parser) SetLocation(loc *time.Location) {
+	p.loc = loc
+}
+
+// Params returns typed parameter declarations found in parsed text.
+func (p *Parser) Params() map[string]Param {
+	return p.params
+}
+
+// Collation returns collation set by COLLATE clause or nil.
+func (p *Parser) Collation() *options.Collation {
+	return p.collation
+}
+
+func (p *Parser) Parse() (*Node, error) {
+	err := p.parseLets()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := p.parseTree()
+	if err != nil {
+		return nil, err
+	}
+
+	var text bool
+
+	err = checkTextNode(n, "", &text)
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// checkTextNode checks that TEXT clause is used only once and
+// not inside or, not or array quantifier block, where is a name of
+// enclosing construction.
+func checkTextNode(n *Node, where string, text *bool) error {
+	if n == nil {
+		return nil
+	}
+
+	if where == "" && (n.Op == "or" || n.Op == "not") {
+		where = n.Op
+	}
+
+	for _, e := range []*Expression{n.L, n.R} {
+		err := checkTextExpression(e, where, text)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := checkTextNode(n.LN, where, text)
+	if err != nil {
+		return err
+	}
+
+	return checkTextNode(n.RN, where, text)
+}
+
+func checkTextExpression(e *Expression, where string, text *bool) error {
+	if e == nil {
+		return nil
+	}
+
+	switch e.RT {
+	case VTText:
+		if where != "" {
+			return fmt.Errorf("TEXT can not be used inside %s: line %d; column %d", where, e.S.l, e.S.c)
+		}
+
+		if *text {
+			return fmt.Errorf("TEXT can be used only once: line %d; column %d", e.S.l, e.S.c)
+		}
+
+		*text = true
+	case VTNode:
+		in := "array quantifier"
+		if e.Op == "optional" {
+			in = where
+		}
+
+		err := checkTextNode(e.RN, in, text)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.Links != nil {
+		for _, le := range *e.Links {
+			err := checkTextExpression(le, where, text)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseBlock parses nested block until closing parenthesis,
+// opening parenthesis should be read already.
+func (p *Parser) parseBlock() (*Node, error) {
+	block := p.block
+	p.block = true
+
+	defer func() {
+		p.block = block
+	}()
+
+	n, err := p.parseTree()
+	if err != nil {
+		return nil, err
+	}
+
+	if n.L == nil && n.LN == nil {
+		return nil, p.positionError("empty block")
+	}
+
+	return n, nil
+}
+
+// parseTree parses clauses until the end of text or closing parenthesis
+// of block and returns compacted tree.
+func (p *Parser) parseTree() (*Node, error) {
+	root := &Node{Op: "and"}
+
+	end, err := p.clausesEnd()
+	if err != nil {
+		return nil, err
+	}
+
+	if !end {
+		root.LN, err = p.parseLogical(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t, l, err := p.readToken(true, "")
+
+	switch {
+	case errors.Is(err, ErrParsed):
+		if p.block {
+			return nil, p.positionError("unexpected end of block (expected ')')")
+		}
+	case err != nil:
+		return nil, err
+	case t == TParentheses && l[0] == ')' && p.block:
+	case t == TKey && bytes.EqualFold(l, keyCollate):
+		err = p.parseCollate()
+		if !errors.Is(err, ErrParsed) {
+			return nil, err
+		}
+	default:
+		return nil, p.unexpectedSymbolError(l)
+	}
+
+	return Compact(root), nil
+}
+
+// clausesEnd reports whether block has no more clauses, that is
+// text or block is ended or COLLATE clause follows.
+func (p *Parser) clausesEnd() (bool, error) {
+	t, l, err := p.peekToken()
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case t == 0:
+		return true, nil
+	case t == TParentheses && l[0] == ')':
+		return true, nil
+	case t == TKey && bytes.EqualFold(l, keyCollate):
+		// COLLATE followed by string is a clause, otherwise it is a field,
+		// both tokens are returned back to queue
+		read := []macroToken{{t: t, l: []byte(string(l))}}
+		_, _, _ = p.nextToken()
+
+		nt, nl, err := p.peekToken()
+		if err != nil {
+			return false, err
+		}
+
+		if nt != 0 {
+			read = append(read, macroToken{t: nt, l: []byte(string(nl))})
+			_, _, _ = p.nextToken()
+		}
+
+		p.queue = append(read, p.queue...)
+
+		return nt == TString, nil
+	}
+
+	return false, nil
+}
+
+// logicalPrecedence returns precedence of binary logical operator,
+// operators with higher precedence bind tighter.
+func logicalPrecedence(t Token, l []byte) (string, int, bool) {
+	if t != TKey {
+		return "", 0, false
+	}
+
+	switch {
+	case bytes.EqualFold(l, keyOr):
+		return "or", 1, true
+	case bytes.EqualFold(l, keyAnd):
+		return "and", 2, true
+	}
+
+	return "", 0, false
+}
+
+// parseLogical parses clauses joined with logical operators which
+// precedence is not less than minPrec. Operators are left associative:
+// `a or b or c` is parsed as `(a or b) or c`.
+func (p *Parser) parseLogical(minPrec int) (*Node, error) {
+	n, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t, l, err := p.peekToken()
+		if err != nil {
+			return nil, err
+		}
+
+		op, prec, ok := logicalPrecedence(t, l)
+		if !ok || prec < minPrec {
+			return n, nil
+		}
+
+		_, _, _ = p.nextToken()
+
+		rn, err := p.parseLogical(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		n = &Node{Op: op, LN: n, RN: rn}
+	}
+}
+
+// parseNot parses clause with any number of negations
+// (`NOT a = 1` or `!(...)`), negation binds tighter than AND and OR.
+func (p *Parser) parseNot() (*Node, error) {
+	t, l, err := p.readToken(false, "unexpected end of expression")
+	if err != nil {
+		return nil, err
+	}
+
+	if (t == TKey && bytes.EqualFold(l, keyNot)) ||
+		(t == TOp && len(l) == 1 && l[0] == '!') {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Node{Op: "not", LN: n}, nil
+	}
+
+	return p.parseClause(t, l)
+}
+
+// parseClause parses group in parentheses, optional clause or expression.
+// Expression is returned as node with single operand.
+func (p *Parser) parseClause(t Token, l []byte) (*Node, error) {
+	switch {
+	case t == TParentheses && l[0] == '(':
+		l = []byte(string(l))
+
+		arith, err := p.arithmeticGroup()
+		if err != nil {
+			return nil, err
+		}
+
+		if !arith {
+			return p.parseBlock()
+		}
+
+	case t == TQuestion:
+		return p.parseOptional()
+
+	case t == TArith && l[0] == '-':
+
+	case t != TKey && !IsPrimitive(t):
+		return nil, p.unexpectedSymbolError(l)
+
+	case bytes.EqualFold(l, keyAnd) || bytes.EqualFold(l, keyOr):
+		return nil, p.unexpectedSymbolError(l)
+
+	case bytes.EqualFold(l, keyOptional):
+		l = []byte(string(l))
+
+		pt, pl, err := p.peekToken()
+		if err != nil {
+			return nil, err
+		}
+
+		if pt == TParentheses && pl[0] == '(' {
+			return p.parseOptional()
+		}
+	}
+
+	e, err := p.parseExpression(t, l)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Node{Op: "and", L: &e}, nil
+}
+
+// parseOptional parses optional clause `?a = $a`, `?(a = $a or b = $b)`
+// or `OPTIONAL(...)`. Clause is removed at compile time if any of
+// its parameters is omitted.
+func (p *Parser) parseOptional() (*Node, error) {
+	used := p.used
+	p.used = map[string]bool{}
+
+	defer func() {
+		p.used = used
+	}()
+
+	t, l, err := p.readToken(false, "expected optional clause")
+	if err != nil {
+		return nil, err
+	}
+
+	var block *Node
+
+	group := t == TParentheses && l[0] == '('
+	if group {
+		l = []byte(string(l))
+
+		arith, err := p.arithmeticGroup()
+		if err != nil {
+			return nil, err
+		}
+
+		group = !arith
+	}
+
+	if group {
+		block, err = p.parseBlock()
+	} else {
+		var e Expression
+
+		e, err = p.parseExpression(t, l)
+		block = &Node{Op: "and", L: &e}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.used) == 0 {
+		return nil, p.positionError("optional clause has no parameters")
+	}
+
+	oe := &Expression{
+		Op: "optional",
+		RT: VTNode,
+		RN: block,
+	}
+
+	for name := range p.used {
+		oe.Optional = append(oe.Optional, name)
+	}
+
+	sort.Strings(oe.Optional)
+
+	return &Node{Op: "and", L: oe}, nil
+}
+
+// arithmeticGroup reports whether parentheses which are opened
+// at the beginning of clause enclose arithmetic operand
+// (like `(a + b) * 2 > c`) rather than logical group. Group ends clause,
+// so it is followed by end of text or block, AND, OR or COLLATE.
+// Tokens read ahead are returned back to queue.
+func (p *Parser) arithmeticGroup() (bool, error) {
+	var read []macroToken
+
+	defer func() {
+		p.queue = append(read, p.queue...)
+	}()
+
+	depth := 0
+
+	for {
+		t, l, err := p.nextToken()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		read = append(read, macroToken{t: t, l: []byte(string(l))})
+
+		if t != TParentheses || (l[0] != '(' && l[0] != ')') {
+			continue
+		}
+
+		if l[0] == '(' {
+			depth++
+			continue
+		}
+
+		if depth > 0 {
+			depth--
+			continue
+		}
+
+		t, l, err = p.nextToken()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		read = append(read, macroToken{t: t, l: []byte(string(l))})
+
+		_, _, logical := logicalPrecedence(t, l)
+
+		return !logical && t != TParentheses && !(t == TKey && bytes.EqualFold(l, keyCollate)), nil
+	}
+}
+
+func token(t Token, in ...Token) bool {
+	for _, tin := range in {
+		if tin == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Parser) readToken(canBeEnd bool, unexpected string) (Token, []byte, error) {
+	t, l, err := p.nextToken()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			if canBeEnd {
+				return 0, nil, ErrParsed
+			}
+
+			return 0, nil, p.positionError(unexpected)
+		}
+
+		return 0, nil, err
+	}
+
+	return t, l, nil
+}
+
+func (p *Parser) readAndCheckToken(canBeEnd bool, unexpected string, tokens ...Token) (Token, []byte, error) {
+	t, l, err := p.readToken(canBeEnd, unexpected)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if !token(t, tokens...) {
+		return 0, nil, p.unexpectedSymbolError(l)
+	}
+
+	return t, l, nil
+}
+
+// nextToken returns token returned back with unreadToken or reads next one,
+// macro references are replaced with tokens of macro body.
+func (p *Parser) nextToken() (Token, []byte, error) {
+	if p.backTok != 0 {
+		t := p.backTok
+		p.backTok = 0
+		return t, p.backLit, nil
+	}
+
+	for {
+		t, l, err := p.rawToken()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if t != TMacro {
+			return t, l, nil
+		}
+
+		name := string(l)
+
+		args, err := p.readMacroArgs()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		tokens, err := p.expandMacro(name, args, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		p.queue = append(tokens, p.queue...)
+	}
+}
+
+// unreadToken returns token back, so it will be returned by next read.
+func (p *Parser) unreadToken(t Token, l []byte) {
+	p.backTok = t
+	p.backLit = append(p.backLit[:0], l...)
+}
+
+// peekToken reads next token and returns it back, at the end of
+// text zero token is returned.
+func (p *Parser) peekToken() (Token, []byte, error) {
+	t, l, err := p.nextToken()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, nil
+		}
+
+		return 0, nil, err
+	}
+
+	p.unreadToken(t, l)
+	return t, p.backLit, nil
+}
+
+// operandShape describes right side of operator.
+type operandShape uint
+
+const (
+	// any primitive value or key.
+	shapeValue operandShape = iota + 1
+	// array of values.
+	shapeArray
+	// non negative integer.
+	shapeSize
+	// type name, type number or array of them.
+	shapeType
+	// array of divisor and remainder.
+	shapeMod
+	// non negative integer bitmask or array of bit positions.
+	shapeBits
+	// bool or number.
+	shapeExists
+	// regex or string.
+	shapeRegex
+	// embedded document.
+	shapeDocument
+)
+
+// operators is a set of supported operators with shapes of their right side.
+var operators = map[string]operandShape{
+	"=":             shapeValue,
+	"!=":            shapeValue,
+	"<>":            shapeValue,
+	"<":             shapeValue,
+	">":             shapeValue,
+	"<=":            shapeValue,
+	">=":            shapeValue,
+	"$eq":           shapeValue,
+	"$ne":           shapeValue,
+	"$gt":           shapeValue,
+	"$gte":          shapeValue,
+	"$lt":           shapeValue,
+	"$lte":          shapeValue,
+	"$in":           shapeArray,
+	"$nin":          shapeArray,
+	"$all":          shapeArray,
+	"$size":         shapeSize,
+	"$type":         shapeType,
+	"$mod":          shapeMod,
+	"$bitsAllSet":   shapeBits,
+	"$bitsAnySet":   shapeBits,
+	"$bitsAllClear": shapeBits,
+	"$bitsAnyClear": shapeBits,
+	"$exists":       shapeExists,
+	"$regex":        shapeRegex,
+	"$elemMatch":    shapeDocument,
+}
+
+// typeNames are aliases accepted by $type operator.
+var typeNames = map[string]bool{
+	"double":              true,
+	"string":              true,
+	"object":              true,
+	"array":               true,
+	"binData":             true,
+	"undefined":           true,
+	"objectId":            true,
+	"bool":                true,
+	"date":                true,
+	"null":                true,
+	"regex":               true,
+	"dbPointer":           true,
+	"javascript":          true,
+	"symbol":              true,
+	"javascriptWithScope": true,
+	"int":                 true,
+	"timestamp":           true,
+	"long":                true,
+	"decimal":             true,
+	"minKey":              true,
+	"maxKey":              true,
+	"number":              true,
+}
+
+func (p *Parser) parseExpression(startT Token, startL []byte) (Expression, error) {
+	var e Expression
+	var err error
+
+	if startT == TKey && bytes.EqualFold(startL, keyFuncText) {
+		startL = []byte(string(startL))
+
+		t, l, err := p.peekToken()
+		if err != nil {
+			return e, err
+		}
+
+		if t == TParentheses && l[0] == '(' {
+			return p.parseText()
+		}
+	}
+
+	if startT == TKey && bytes.Equal(startL, keyFuncJSON) {
+		t, l, err := p.peekToken()
+		if err != nil {
+			return e, err
+		}
+
+		if t == TParentheses && l[0] == '(' {
+			e.JSON, err = p.parseJSON()
+			e.Op, e.RT = "$json", VTJSON
+			return e, err
+		}
+
+		startL = keyFuncJSON
+	}
+
+	if startT == TKey && stringPredicates[strings.ToLower(string(startL))] {
+		op := strings.ToLower(string(startL))
+		startL = []byte(string(startL))
+
+		t, l, err := p.peekToken()
+		if err != nil {
+			return e, err
+		}
+
+		if t == TParentheses && l[0] == '(' {
+			return p.parseStringPredicate(op)
+		}
+	}
+
+	// `=` after typed parameter on the left side is an operator,
+	// not a default
+	p.left = true
+	e.L, e.LT, e.LC, err = p.parseOperand(startT, startL)
+	p.left = false
+
+	if err != nil {
+		return e, err
+	}
+
+	// e.S = p.s.Position()
+
+	_, l, err := p.readAndCheckToken(false, "unexpected end of expression", TOp, TKey)
+	if err != nil {
+		return e, err
+	}
+
+	e.Op = string(l)
+
+	if quantifier(l) {
+		return p.parseQuantifier(e)
+	}
+
+	if bytes.Equal(l, keyFuncJSON) {
+		if e.LT != VTKey {
+			return e, p.positionError("JSON expects field on the left side")
+		}
+
+		e.JSON, err = p.parseJSON()
+		e.Op, e.RT = "$json", VTJSON
+		return e, err
+	}
+
+	if op, ok := geoOps[strings.ToLower(e.Op)]; ok {
+		if e.LT != VTKey {
+			return e, p.positionError(fmt.Sprintf("%s expects field on the left side", e.Op))
+		}
+
+		e.Op = op
+		return p.parseGeo(e)
+	}
+
+	if bytes.EqualFold(l, keyBetween) {
+		return p.parseBetween(e)
+	}
+
+	if bytes.EqualFold(l, keyIn) {
+		e.Op = "$in"
+	} else if bytes.EqualFold(l, keyNot) {
+		_, l, err = p.readAndCheckToken(false, "expected 'in'", TKey)
+		if err != nil {
+			return e, err
+		}
+
+		if !bytes.EqualFold(l, keyIn) {
+			return e, p.unexpectedSymbolError(l)
+		}
+
+		e.Op = "$nin"
+	}
+
+	if bytes.EqualFold(l, keyEquals) {
+		for _, kw := range []string{"ignore", "case"} {
+			_, l, err = p.readAndCheckToken(false, "expected 'IGNORE CASE'", TKey)
+			if err != nil {
+				return e, err
+			}
+
+			if !strings.EqualFold(string(l), kw) {
+				return e, p.unexpectedSymbolError(l)
+			}
+		}
+
+		e.Op = "=~"
+	}
+
+	if likeOp := strings.ToLower(e.Op); likeOp == "like" || likeOp == "ilike" || likeOp == "=~" {
+		if e.LT != VTKey {
+			return e, p.positionError(fmt.Sprintf("%s expects field on the left side", e.Op))
+		}
+
+		e.Op = likeOp
+		e.R, e.RT, err = p.readOperand(nil, TString, TKey)
+		if err == nil && e.RT != VTString && e.RT != VTParam {
+			err = p.positionError(fmt.Sprintf("%s expects string or parameter", e.Op))
+		}
+
+		return e, err
+	}
+
+	if calendarOp(e.Op) {
+		t, l, err := p.peekToken()
+		if err != nil {
+			return e, err
+		}
+
+		if t == TKey && calendarUnits[string(l)] {
+			return p.parseCalendar(e)
+		}
+	}
+
+	shape, ok := operators[e.Op]
+	if !ok {
+		return e, p.positionError(fmt.Sprintf("unsupported operator %s", l))
+	}
+
+	if e.LT == VTCalc && shape != shapeValue {
+		return e, p.positionError(fmt.Sprintf("operator %s can not be used with calculated operand", e.Op))
+	}
+
+	switch shape {
+	case shapeArray:
+		e.R, e.RT, err = p.readArrayOrParam(nil)
+	case shapeSize:
+		e.R, e.RT, err = p.readOperand(checkSize, TNumber)
+	case shapeType:
+		e.R, e.RT, err = p.readOperandOrArray(checkType, TString, TNumber)
+	case shapeMod:
+		e.R, e.RT, err = p.readArray(checkNumber)
+		if err == nil && binary.BigEndian.Uint32(e.R) != 2 {
+			err = p.positionError("$mod expects array of divisor and remainder")
+		}
+	case shapeBits:
+		e.R, e.RT, err = p.readOperandOrArray(checkSize, TNumber)
+	case shapeExists:
+		e.R, e.RT, err = p.readOperand(nil, TBool, TNumber)
+	case shapeRegex:
+		e.R, e.RT, err = p.readOperand(nil, TRegex, TString)
+	case shapeDocument:
+		e.R, e.RT, err = p.readOperand(checkDocument, TParentheses)
+	default:
+		var t Token
+		t, l, err = p.readAndCheckToken(false, "unexpected end of expression",
+			append(PrimitiveTypesAndKey, TParentheses, TArith)...)
+		if err == nil {
+			e.R, e.RT, e.RC, err = p.parseOperand(t, l)
+		}
+	}
+
+	if err != nil {
+		return e, err
+	}
+
+	if rangeOp(e.Op) {
+		e, err = p.parseChain(e)
+		if err != nil {
+			return e, err
+		}
+	}
+
+	err = p.normalizeOperands(&e)
+	if err != nil {
+		return e, err
+	}
+
+	if e.Links != nil {
+		for _, le := range *e.Links {
+			err = p.normalizeOperands(le)
+			if err != nil {
+				return e, err
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// normalizeOperands swaps operands of comparison that has field only
+// on the right side, so `5 < a` becomes `a > 5`. It is the only place
+// where operands are swapped, encoders expect field on the left side.
+func (p *Parser) normalizeOperands(e *Expression) error {
+	if !fieldOperand(e.LT) && !fieldOperand(e.RT) {
+		return p.positionError(fmt.Sprintf("comparison %s has no field", e.Op))
+	}
+
+	if e.RT != VTKey || fieldOperand(e.LT) {
+		return nil
+	}
+
+	e.L, e.LT, e.LC, e.R, e.RT, e.RC = e.R, e.RT, e.RC, e.L, e.LT, e.LC
+	e.Op = reversedOp(e.Op)
+
+	return nil
+}
+
+// fieldOperand reports whether operand refers to document: field,
+// calculation or aggregation variable.
+func fieldOperand(vt ValueType) bool {
+	return vt == VTKey || vt == VTCalc || vt == VTVar
+}
+
+// parseCollate parses collation of query `COLLATE 'en' STRENGTH 2`,
+// it should be the last clause of query.
+func (p *Parser) parseCollate() error {
+	if p.block {
+		return p.positionError("COLLATE can be used only at the end of query")
+	}
+
+	locale, err := p.readLiteralArg()
+	if err != nil {
+		return err
+	}
+
+	c := &options.Collation{Locale: locale}
+
+	for {
+		t, l, err := p.readToken(true, "")
+		if err != nil {
+			if errors.Is(err, ErrParsed) {
+				p.collation = c
+			}
+
+			return err
+		}
+
+		if t != TKey {
+			return p.unexpectedSymbolError(l)
+		}
+
+		switch strings.ToLower(string(l)) {
+		case "strength":
+			var s string
+
+			s, err = p.readLiteralArg()
+			if err == nil {
+				c.Strength, err = strconv.Atoi(s)
+				if err != nil || c.Strength < 1 || c.Strength > 5 {
+					err = p.positionError("STRENGTH expects number from 1 to 5")
+				}
+			}
+		case "case_level":
+			c.CaseLevel = true
+		case "case_first":
+			c.CaseFirst, err = p.readCollationArg("CASE_FIRST", "upper", "lower", "off")
+		case "numeric_ordering":
+			c.NumericOrdering = true
+		case "alternate":
+			c.Alternate, err = p.readCollationArg("ALTERNATE", "non-ignorable", "shifted")
+		case "max_variable":
+			c.MaxVariable, err = p.readCollationArg("MAX_VARIABLE", "punct", "space")
+		case "normalization":
+			c.Normalization = true
+		case "backwards":
+			c.Backwards = true
+		default:
+			return p.unexpectedSymbolError(l)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCollationArg reads string argument of collation option
+// that should be one of values.
+func (p *Parser) readCollationArg(option string, values ...string) (string, error) {
+	s, err := p.readLiteralArg()
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range values {
+		if s == v {
+			return s, nil
+		}
+	}
+
+	return "", p.positionError(fmt.Sprintf("%s expects one of %s", option, strings.Join(values, ", ")))
+}
+
+// calendarUnits are calendar periods.
+var calendarUnits = map[string]bool{
+	"TODAY": true,
+	"DAY":   true,
+	"WEEK":  true,
+	"MONTH": true,
+	"YEAR":  true,
+}
+
+func calendarOp(op string) bool {
+	return op == "=" || op == "!=" || op == "<>" || op == "$in" || op == "$nin"
+}
+
+// parseCalendar parses calendar period `TODAY("Europe/Moscow")`,
+// `MONTH("2022-01")` or `WEEK($date, $zone)`. If period is not followed by
+// parenthesis it is a field (`a = DAY`).
+func (p *Parser) parseCalendar(e Expression) (Expression, error) {
+	t, l, _ := p.nextToken()
+	unit := string(l)
+
+	pt, pl, err := p.peekToken()
+	if err != nil {
+		return e, err
+	}
+
+	if pt != TParentheses || pl[0] != '(' {
+		if e.Op == "$in" || e.Op == "$nin" {
+			return e, p.unexpectedSymbolError([]byte(unit))
+		}
+
+		e.R, e.RT, e.RC, err = p.parseOperand(t, []byte(unit))
+		return e, err
+	}
+
+	if e.LT != VTKey {
+		return e, p.positionError(fmt.Sprintf("%s expects field on the left side", unit))
+	}
+
+	_, _, _ = p.nextToken()
+
+	maxArgs := 2
+	if unit == "TODAY" {
+		maxArgs = 1
+	}
+
+	var args [][]byte
+	var argTypes []ValueType
+
+	for {
+		t, l, err = p.readAndCheckToken(false, "unexpected end of expression",
+			TString, TKey, TParentheses, TComma)
+		if err != nil {
+			return e, err
+		}
+
+		if t == TParentheses && l[0] == ')' {
+			break
+		}
+
+		if len(args) > 0 {
+			if t != TComma {
+				return e, p.unexpectedSymbolError(l)
+			}
+
+			t, l, err = p.readAndCheckToken(false, "unexpected end of expression", TString, TKey)
+			if err != nil {
+				return e, err
+			}
+		}
+
+		if len(args) == maxArgs || t == TParentheses || t == TComma {
+			return e, p.unexpectedSymbolError(l)
+		}
+
+		v, vt, err := p.tokenValue(t, l)
+		if err != nil {
+			return e, err
+		}
+
+		args = append(args, v)
+		argTypes = append(argTypes, vt)
+	}
+
+	cal := &Calendar{Unit: unit, Loc: p.loc}
+
+	if unit != "TODAY" && len(args) > 0 {
+		cal.Date, cal.DateT = args[0], argTypes[0]
+		args, argTypes = args[1:], argTypes[1:]
+
+		if cal.DateT != VTDate && cal.DateT != VTString && cal.DateT != VTParam {
+			return e, p.positionError(fmt.Sprintf("%s expects date, date string or parameter", unit))
+		}
+	}
+
+	if len(args) > 0 {
+		switch argTypes[0] {
+		case VTString:
+			zone := string(args[0][1 : len(args[0])-1])
+
+			cal.Loc, err = time.LoadLocation(zone)
+			if err != nil {
+				return e, p.positionError(fmt.Sprintf("unknown time zone %s", zone))
+			}
+		case VTParam:
+			cal.ZoneParam = string(args[0])
+		default:
+			return e, p.positionError(fmt.Sprintf("%s expects time zone string or parameter", unit))
+		}
+	}
+
+	// date string is checked here if zone is known
+	if cal.DateT == VTString && cal.ZoneParam == "" {
+		ds := string(cal.Date[1 : len(cal.Date)-1])
+
+		dt, err := parseDate(ds, cal.Loc)
+		if err != nil {
+			return e, p.positionError(fmt.Sprintf("invalid date %s", ds))
+		}
+
+		cal.Date, cal.DateT = binary.BigEndian.AppendUint64(nil, uint64(dt.UnixMilli())), VTDate
+	}
+
+	e.Cal, e.RT = cal, VTCalendar
+	return e, nil
+}
+
+func rangeOp(op string) bool {
+	return op == "<" || op == "<=" || op == ">" || op == ">="
+}
+
+// parseChain parses chained comparison like `30 <= age < 40`,
+// every next comparison is linked to the first expression.
+func (p *Parser) parseChain(e Expression) (Expression, error) {
+	prev := &e
+
+	for {
+		t, l, err := p.peekToken()
+		if err != nil {
+			return e, err
+		}
+
+		if t != TOp || !rangeOp(string(l)) {
+			return e, nil
+		}
+
+		ne := &Expression{
+			Op: string(l),
+			L:  prev.R,
+			LT: prev.RT,
+			LC: prev.RC,
+		}
+
+		_, _, _ = p.nextToken()
+
+		t, l, err = p.readAndCheckToken(false, "unexpected end of expression",
+			append(PrimitiveTypesAndKey, TParentheses, TArith)...)
+		if err != nil {
+			return e, err
+		}
+
+		ne.R, ne.RT, ne.RC, err = p.parseOperand(t, l)
+		if err != nil {
+			return e, err
+		}
+
+		if e.Links == nil {
+			e.Links = &[]*Expression{}
+		}
+
+		*e.Links = append(*e.Links, ne)
+		prev = ne
+	}
+}
+
+// parseBetween parses range `a BETWEEN 1 AND 5` (inclusive) or
+// interval `a BETWEEN [1, 5)` where square bracket means inclusive bound
+// and parenthesis means exclusive bound.
+func (p *Parser) parseBetween(e Expression) (Expression, error) {
+	he := &Expression{
+		L:  e.L,
+		LT: e.LT,
+		LC: e.LC,
+	}
+
+	t, l, err := p.readAndCheckToken(false, "unexpected end of expression",
+		append(PrimitiveTypesAndKey, TParentheses, TArith)...)
+	if err != nil {
+		return e, err
+	}
+
+	interval := t == TParentheses && (l[0] == '[' || l[0] == '(')
+
+	e.Op, he.Op = ">=", "<="
+	if interval {
+		if l[0] == '(' {
+			e.Op = ">"
+		}
+
+		t, l, err = p.readToken(false, "unexpected end of expression")
+		if err != nil {
+			return e, err
+		}
+	}
+
+	e.R, e.RT, e.RC, err = p.parseOperand(t, l)
+	if err != nil {
+		return e, err
+	}
+
+	if interval {
+		_, _, err = p.readAndCheckToken(false, "expected ','", TComma)
+	} else {
+		_, l, err = p.readAndCheckToken(false, "expected 'and'", TKey)
+		if err == nil && !bytes.EqualFold(l, keyAnd) {
+			err = p.unexpectedSymbolError(l)
+		}
+	}
+
+	if err != nil {
+		return e, err
+	}
+
+	t, l, err = p.readToken(false, "unexpected end of expression")
+	if err != nil {
+		return e, err
+	}
+
+	he.R, he.RT, he.RC, err = p.parseOperand(t, l)
+	if err != nil {
+		return e, err
+	}
+
+	if interval {
+		_, l, err = p.readAndCheckToken(false, "expected ']' or ')'", TParentheses)
+		if err != nil {
+			return e, err
+		}
+
+		switch l[0] {
+		case ')':
+			he.Op = "<"
+		case ']':
+		default:
+			return e, p.unexpectedSymbolError(l)
+		}
+	}
+
+	e.Links = &[]*Expression{he}
+	return e, nil
+}
+
+// parseText parses full-text search clause
+// `TEXT("coffee shop" LANGUAGE "en" CASE_SENSITIVE DIACRITIC_SENSITIVE)`,
+// search string and language can be parameters.
+func (p *Parser) parseText() (Expression, error) {
+	line, column := p.s.Position()
+
+	e := Expression{
+		Op:   "$text",
+		L:    keyText,
+		LT:   VTKey,
+		RT:   VTText,
+		S:    pos{l: line, c: column},
+		Text: &Text{},
+	}
+
+	_, _, _ = p.nextToken()
+
+	var err error
+
+	e.Text.Search, e.Text.SearchT, err = p.readOperand(nil, TString, TKey)
+	if err != nil {
+		return e, err
+	}
+
+	if e.Text.SearchT != VTString && e.Text.SearchT != VTParam {
+		return e, p.positionError("TEXT expects search string or parameter")
+	}
+
+	for {
+		t, l, err := p.readAndCheckToken(false, "expected ')'", TKey, TParentheses)
+		if err != nil {
+			return e, err
+		}
+
+		if t == TParentheses {
+			if l[0] != ')' {
+				return e, p.unexpectedSymbolError(l)
+			}
+
+			return e, nil
+		}
+
+		switch strings.ToLower(string(l)) {
+		case "language":
+			e.Text.Language, e.Text.LanguageT, err = p.readOperand(nil, TString, TKey)
+			if err == nil && e.Text.LanguageT != VTString && e.Text.LanguageT != VTParam {
+				err = p.positionError("LANGUAGE expects string or parameter")
+			}
+
+			if err != nil {
+				return e, err
+			}
+		case "case_sensitive":
+			e.Text.CaseSensitive = true
+		case "diacritic_sensitive":
+			e.Text.DiacriticSensitive = true
+		default:
+			return e, p.unexpectedSymbolError(l)
+		}
+	}
+}
+
+// geoOps are geospatial predicates.
+var geoOps = map[string]string{
+	"near":       "$near",
+	"within":     "$geoWithin",
+	"intersects": "$geoIntersects",
+}
+
+// distanceUnits are multipliers of distance units to meters.
+var distanceUnits = map[string]float64{
+	"m":  1,
+	"km": 1000,
+	"mi": 1609.344,
+	"ft": 0.3048,
+}
+
+// parseJSON parses extended JSON fragment `JSON({"$jsonSchema": {...}})`.
+// Fragment is read as text up to closing parenthesis and decoded
+// by extended JSON reader.
+func (p *Parser) parseJSON() (bson.D, error) {
+	_, _, _ = p.nextToken()
+
+	_, text, err := p.readAndCheckToken(false, "JSON is not closed", TJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.D
+
+	err = bson.UnmarshalExtJSON(text, false, &doc)
+	if err != nil {
+		return nil, p.positionError(fmt.Sprintf("invalid JSON: %v", err))
+	}
+
+	_, _, err = p.readAndCheckToken(false, "JSON is not closed", TParentheses)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// parseGeo parses geometry of geospatial predicate:
+// `loc NEAR [SPHERE] point(lng, lat) [WITHIN 500m]`,
+// `loc WITHIN box(lng1, lat1, lng2, lat2)`, `loc WITHIN circle(lng, lat, 1km)`,
+// `loc WITHIN polygon([[lng, lat], ...])` or `loc INTERSECTS $geometry`.
+func (p *Parser) parseGeo(e Expression) (Expression, error) {
+	t, l, err := p.readAndCheckToken(false, "expected geometry", TKey)
+	if err != nil {
+		return e, err
+	}
+
+	if e.Op == "$near" && bytes.EqualFold(l, keySphere) {
+		e.Op = "$nearSphere"
+
+		t, l, err = p.readAndCheckToken(false, "expected geometry", TKey)
+		if err != nil {
+			return e, err
+		}
+	}
+
+	e.G, err = p.parseGeometry(t, l)
+	if err != nil {
+		return e, err
+	}
+
+	e.RT = VTGeo
+
+	switch {
+	case e.Op == "$geoIntersects" && e.G.Type == "Circle":
+		return e, p.positionError("circle can be used only with WITHIN")
+	case e.Op == "$near" || e.Op == "$nearSphere":
+		if e.G.Type != "" && e.G.Type != "Point" {
+			return e, p.positionError(fmt.Sprintf("%s expects point", e.Op))
+		}
+
+		t, l, err = p.peekToken()
+		if err != nil {
+			return e, err
+		}
+
+		if t != TKey || !bytes.EqualFold(l, []byte("within")) {
+			return e, nil
+		}
+
+		_, _, _ = p.nextToken()
+
+		t, l, err = p.readToken(false, "expected distance")
+		if err != nil {
+			return e, err
+		}
+
+		if t == TKey && l[0] == '$' {
+			e.G.Dist, e.G.DistT, err = p.parseParam(l)
+			if err != nil || e.G.DistT == VTParam {
+				return e, err
+			}
+
+			// parameter of macro bound to number
+			lv, _ := literalValue(e.G.Dist, e.G.DistT)
+
+			d, ok := convertDouble(lv)
+			if !ok || d.(float64) < 0 {
+				return e, p.positionError("distance must be a non-negative number")
+			}
+
+			e.G.Dist = binary.BigEndian.AppendUint64(nil, math.Float64bits(d.(float64)))
+			e.G.DistT = VTFloat
+
+			return e, nil
+		}
+
+		var d float64
+		d, err = p.parseDistance(t, l)
+		if err != nil {
+			return e, err
+		}
+
+		e.G.Dist = binary.BigEndian.AppendUint64(nil, math.Float64bits(d))
+		e.G.DistT = VTFloat
+	}
+
+	return e, nil
+}
+
+// parseGeometry parses geometry function or parameter.
+func (p *Parser) parseGeometry(t Token, l []byte) (*Geo, error) {
+	if l[0] == '$' {
+		prm, vt, err := p.parseParam(l)
+		if err != nil {
+			return nil, err
+		}
+
+		if vt != VTParam {
+			return nil, p.positionError(fmt.Sprintf("expected geometry, got %s", prm))
+		}
+
+		return &Geo{Param: string(prm)}, nil
+	}
+
+	name := strings.ToLower(string(l))
+
+	_, l, err := p.readAndCheckToken(false, "expected '('", TParentheses)
+	if err != nil {
+		return nil, err
+	}
+
+	if l[0] != '(' {
+		return nil, p.unexpectedSymbolError(l)
+	}
+
+	g := &Geo{}
+
+	switch name {
+	case "point":
+		g.Type = "Point"
+
+		var pt [2]float64
+		pt, err = p.readGeoPoint(false)
+		g.Coords = [][2]float64{pt}
+	case "box":
+		g.Type = "Polygon"
+
+		var min, max [2]float64
+		min, err = p.readGeoPoint(false)
+		if err == nil {
+			_, _, err = p.readAndCheckToken(false, "expected ','", TComma)
+		}
+		if err == nil {
+			max, err = p.readGeoPoint(false)
+		}
+
+		g.Coords = [][2]float64{
+			min, {max[0], min[1]}, max, {min[0], max[1]}, min,
+		}
+	case "circle":
+		g.Type = "Circle"
+
+		var c [2]float64
+		c, err = p.readGeoPoint(false)
+		g.Coords = [][2]float64{c}
+
+		if err == nil {
+			_, _, err = p.readAndCheckToken(false, "expected ','", TComma)
+		}
+
+		if err == nil {
+			t, l, err = p.readToken(false, "expected radius")
+			if err == nil {
+				g.Radius, err = p.parseDistance(t, l)
+			}
+		}
+	case "polygon":
+		g.Type = "Polygon"
+		g.Coords, err = p.readGeoRing()
+	default:
+		return nil, p.positionError(fmt.Sprintf("unknown geometry %s", name))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, l, err = p.readAndCheckToken(false, "expected ')'", TParentheses)
+	if err != nil {
+		return nil, err
+	}
+
+	if l[0] != ')' {
+		return nil, p.unexpectedSymbolError(l)
+	}
+
+	return g, nil
+}
+
+// readGeoPoint reads `lng, lat` or `[lng, lat]` if bracketed is true.
+func (p *Parser) readGeoPoint(bracketed bool) ([2]float64, error) {
+	var pt [2]float64
+	var err error
+
+	if bracketed {
+		_, err = p.readArrayOpen()
+		if err != nil {
+			return pt, err
+		}
+	}
+
+	pt[0], err = p.readGeoNumber()
+	if err != nil {
+		return pt, err
+	}
+
+	_, _, err = p.readAndCheckToken(false, "expected ','", TComma)
+	if err != nil {
+		return pt, err
+	}
+
+	pt[1], err = p.readGeoNumber()
+	if err != nil {
+		return pt, err
+	}
+
+	if pt[0] < -180 || pt[0] > 180 || pt[1] < -90 || pt[1] > 90 {
+		return pt, p.positionError(fmt.Sprintf("invalid coordinates [%g, %g]", pt[0], pt[1]))
+	}
+
+	if bracketed {
+		_, l, err := p.readAndCheckToken(false, "expected ']'", TParentheses)
+		if err != nil {
+			return pt, err
+		}
+
+		if l[0] != ']' {
+			return pt, p.unexpectedSymbolError(l)
+		}
+	}
+
+	return pt, nil
+}
+
+// readGeoRing reads polygon ring `[[lng, lat], ...]`, ring is closed
+// if last point differs from the first one.
+func (p *Parser) readGeoRing() ([][2]float64, error) {
+	_, err := p.readArrayOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	var ring [][2]float64
+
+	for {
+		pt, err := p.readGeoPoint(true)
+		if err != nil {
+			return nil, err
+		}
+
+		ring = append(ring, pt)
+
+		_, l, err := p.readAndCheckToken(false, "expected ',' or ']'", TComma, TParentheses)
+		if err != nil {
+			return nil, err
+		}
+
+		if l[0] == ']' {
+			break
+		}
+
+		if l[0] != ',' {
+			return nil, p.unexpectedSymbolError(l)
+		}
+	}
+
+	if ring[0] != ring[len(ring)-1] {
+		ring = append(ring, ring[0])
+	}
+
+	if len(ring) < 4 {
+		return nil, p.positionError("polygon expects at least 3 points")
+	}
+
+	return ring, nil
+}
+
+func (p *Parser) readArrayOpen() ([]byte, error) {
+	_, l, err := p.readAndCheckToken(false, "expected '['", TParentheses)
+	if err != nil {
+		return nil, err
+	}
+
+	if l[0] != '[' {
+		return nil, p.unexpectedSymbolError(l)
+	}
+
+	return l, nil
+}
+
+// readGeoNumber reads number with optional minus sign.
+func (p *Parser) readGeoNumber() (float64, error) {
+	t, l, err := p.readAndCheckToken(false, "expected number", TNumber, TArith)
+	if err != nil {
+		return 0, err
+	}
+
+	sign := 1.0
+	if t == TArith {
+		if l[0] != '-' {
+			return 0, p.unexpectedSymbolError(l)
+		}
+
+		sign = -1
+
+		_, l, err = p.readAndCheckToken(false, "expected number", TNumber)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := parseFloat(l)
+	if err != nil {
+		return 0, p.positionError(err.Error())
+	}
+
+	return sign * f, nil
+}
+
+// parseDistance parses non negative distance with optional
+// unit (m, km, mi, ft) and returns it in meters.
+func (p *Parser) parseDistance(t Token, l []byte) (float64, error) {
+	var unit string
+
+	switch t {
+	case TNumberUnit:
+		i := bytes.IndexFunc(l, func(r rune) bool {
+			return r < 128 && isLetter(byte(r))
+		})
+		l, unit = l[:i], string(l[i:])
+	case TNumber:
+		// peek reuses scanner buffer
+		l = []byte(string(l))
+
+		nt, nl, err := p.peekToken()
+		if err != nil {
+			return 0, err
+		}
+
+		if nt == TKey {
+			if _, ok := distanceUnits[strings.ToLower(string(nl))]; ok {
+				unit = string(nl)
+				_, _, _ = p.nextToken()
+			}
+		}
+	default:
+		return 0, p.unexpectedSymbolError(l)
+	}
+
+	d, err := parseFloat(l)
+	if err != nil {
+		return 0, p.positionError(err.Error())
+	}
+
+	if d < 0 {
+		return 0, p.positionError(fmt.Sprintf("negative distance %s", l))
+	}
+
+	if unit != "" {
+		m, ok := distanceUnits[strings.ToLower(unit)]
+		if !ok {
+			return 0, p.positionError(fmt.Sprintf("unknown distance unit %s", unit))
+		}
+
+		d *= m
+	}
+
+	return d, nil
+}
+
+// stringPredicates are predicates written as function call
+// with field and string argument, like `STARTSWITH(name, "abc")`.
+var stringPredicates = map[string]bool{
+	"startswith": true,
+	"endswith":   true,
+	"contains":   true,
+}
+
+// parseStringPredicate parses arguments of string predicate.
+func (p *Parser) parseStringPredicate(op string) (Expression, error) {
+	e := Expression{Op: op}
+
+	_, _, _ = p.nextToken()
+
+	_, l, err := p.readAndCheckToken(false, "expected field", TKey)
+	if err != nil {
+		return e, err
+	}
+
+	e.L, e.LT, err = p.tokenValue(TKey, l)
+	if err != nil {
+		return e, err
+	}
+
+	if e.LT != VTKey {
+		return e, p.positionError(fmt.Sprintf("%s expects field as first argument", op))
+	}
+
+	_, _, err = p.readAndCheckToken(false, "expected ','", TComma)
+	if err != nil {
+		return e, err
+	}
+
+	e.R, e.RT, err = p.readOperand(nil, TString, TKey)
+	if err != nil {
+		return e, err
+	}
+
+	if e.RT != VTString && e.RT != VTParam {
+		return e, p.positionError(fmt.Sprintf("%s expects string or parameter as second argument", op))
+	}
+
+	_, l, err = p.readAndCheckToken(false, "expected ')'", TParentheses)
+	if err != nil {
+		return e, err
+	}
+
+	if l[0] != ')' {
+		return e, p.unexpectedSymbolError(l)
+	}
+
+	return e, nil
+}
+
+// parseOperand parses operand of expression, it is either a single value
+// or arithmetic expression with function calls (VTCalc).
+func (p *Parser) parseOperand(t Token, l []byte) ([]byte, ValueType, *Calc, error) {
+	c, err := p.parseSum(t, l)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if c.Op == "" {
+		return c.V, c.VT, nil, nil
+	}
+
+	if c.TimeCalc() {
+		return nil, VTTimeCalc, c, nil
+	}
+
+	return nil, VTCalc, c, nil
+}
+
+func (p *Parser) parseSum(t Token, l []byte) (*Calc, error) {
+	return p.parseArith(t, l, "+-", p.parseProduct)
+}
+
+func (p *Parser) parseProduct(t Token, l []byte) (*Calc, error) {
+	return p.parseArith(t, l, "*/%", p.parseFactor)
+}
+
+// parseArith parses sequence of operands (parsed with next) joined by
+// arithmetic operators ops of the same precedence (left associative).
+func (p *Parser) parseArith(
+	t Token,
+	l []byte,
+	ops string,
+	next func(Token, []byte) (*Calc, error),
+) (*Calc, error) {
+	c, err := next(t, l)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t, l, err = p.peekToken()
+		if err != nil {
+			return nil, err
+		}
+
+		if t != TArith || !strings.Contains(ops, string(l)) {
+			return c, nil
+		}
+
+		op := string(l)
+		_, _, _ = p.nextToken()
+
+		t, l, err = p.readToken(false, "unexpected end of expression")
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := next(t, l)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.Op == op && (op == "+" || op == "*") {
+			c.Args = append(c.Args, r)
+		} else {
+			c = &Calc{Op: op, Args: []*Calc{c, r}}
+		}
+	}
+}
+
+// parseFactor parses single value, function call, unary minus or
+// arithmetic expression in parentheses.
+func (p *Parser) parseFactor(t Token, l []byte) (*Calc, error) {
+	switch {
+	case t == TParentheses && l[0] == '(':
+		t, l, err := p.readToken(false, "unexpected end of expression")
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := p.parseSum(t, l)
+		if err != nil {
+			return nil, err
+		}
+
+		_, l, err = p.readAndCheckToken(false, "expected ')'", TParentheses)
+		if err != nil {
+			return nil, err
+		}
+
+		if l[0] != ')' {
+			return nil, p.unexpectedSymbolError(l)
+		}
+
+		return c, nil
+
+	case t == TArith && l[0] == '-':
+		t, l, err := p.readToken(false, "unexpected end of expression")
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := p.parseFactor(t, l)
+		if err != nil {
+			return nil, err
+		}
+
+		return negateCalc(c), nil
+
+	case t == TKey && !bytes.Equal(l, keyFuncDate) && !bytes.Equal(l, keyFuncObjectID) &&
+		literalFuncs[string(l)] == nil:
+		name := string(l)
+
+		nt, nl, err := p.peekToken()
+		if err != nil {
+			return nil, err
+		}
+
+		if nt == TParentheses && nl[0] == '(' {
+			if _, ok := calcFuncs[name]; !ok {
+				return nil, p.positionError(fmt.Sprintf("unknown function %s", name))
+			}
+
+			return p.parseFuncCall(name)
+		}
+
+		l = []byte(name)
+	}
+
+	if !IsPrimitiveOrKey(t) && !compositeStart(t, l) {
+		return nil, p.unexpectedSymbolError(l)
+	}
+
+	v, vt, err := p.tokenValue(t, l)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Calc{V: v, VT: vt}, nil
+}
+
+// calcFuncs are functions of calculated operand with min and max
+// number of arguments (-1 for unlimited).
+var calcFuncs = map[string]struct{ min, max int }{
+	"abs":         {1, 1},
+	"ceil":        {1, 1},
+	"floor":       {1, 1},
+	"round":       {1, 2},
+	"trunc":       {1, 2},
+	"sqrt":        {1, 1},
+	"pow":         {2, 2},
+	"exp":         {1, 1},
+	"ln":          {1, 1},
+	"log10":       {1, 1},
+	"min":         {1, -1},
+	"max":         {1, -1},
+	"avg":         {1, -1},
+	"sum":         {1, -1},
+	"size":        {1, 1},
+	"isArray":     {1, 1},
+	"arrayElemAt": {2, 2},
+	"ifNull":      {2, -1},
+	"type":        {1, 1},
+	"strLen":      {1, 1},
+	"toLower":     {1, 1},
+	"toUpper":     {1, 1},
+	"trim":        {1, 1},
+	"concat":      {1, -1},
+	"substr":      {3, 3},
+	"indexOf":     {2, 4},
+	"year":        {1, 1},
+	"month":       {1, 1},
+	"week":        {1, 1},
+	"dayOfMonth":  {1, 1},
+	"dayOfWeek":   {1, 1},
+	"dayOfYear":   {1, 1},
+	"hour":        {1, 1},
+	"minute":      {1, 1},
+	"second":      {1, 1},
+	// NOW() is evaluated at compile time, use $$NOW for server time.
+	"now": {0, 0},
+	"NOW": {0, 0},
+}
+
+// parseFuncCall parses arguments of function call like `strLen(name)`.
+func (p *Parser) parseFuncCall(name string) (*Calc, error) {
+	_, _, _ = p.nextToken()
+
+	c := &Calc{Op: name}
+
+	for {
+		t, l, err := p.readToken(false, "unexpected end of function call")
+		if err != nil {
+			return nil, err
+		}
+
+		if t == TParentheses && l[0] == ')' && len(c.Args) == 0 {
+			break
+		}
+
+		a, err := p.parseSum(t, l)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Args = append(c.Args, a)
+
+		t, l, err = p.readAndCheckToken(false, "expected ',' or ')'", TComma, TParentheses)
+		if err != nil {
+			return nil, err
+		}
+
+		if t == TComma {
+			continue
+		}
+
+		if l[0] != ')' {
+			return nil, p.unexpectedSymbolError(l)
+		}
+
+		break
+	}
+
+	f := calcFuncs[name]
+	if len(c.Args) < f.min || (f.max >= 0 && len(c.Args) > f.max) {
+		return nil, p.positionError(fmt.Sprintf("wrong number of arguments for %s", name))
+	}
+
+	return c, nil
+}
+
+// negateCalc negates numeric literal or makes `0 - c` operation.
+func negateCalc(c *Calc) *Calc {
+	switch c.VT {
+	case VTInteger:
+		n := -int64(binary.BigEndian.Uint64(c.V))
+		return &Calc{V: binary.BigEndian.AppendUint64(nil, uint64(n)), VT: VTInteger}
+	case VTFloat:
+		f := -math.Float64frombits(binary.BigEndian.Uint64(c.V))
+		return &Calc{V: binary.BigEndian.AppendUint64(nil, math.Float64bits(f)), VT: VTFloat}
+	}
+
+	zero := &Calc{V: make([]byte, 8), VT: VTInteger}
+	return &Calc{Op: "-", Args: []*Calc{zero, c}}
+}
+
+func quantifier(l []byte) bool {
+	return bytes.EqualFold(l, keyAny) ||
+		bytes.EqualFold(l, keyAll) ||
+		bytes.EqualFold(l, keyNone)
+}
+
+// parseQuantifier parses array quantifier block like `items ANY (a > 1 and b < 2)`,
+// block is stored as right side node of expression.
+func (p *Parser) parseQuantifier(e Expression) (Expression, error) {
+	if e.LT != VTKey {
+		return e, p.positionError(fmt.Sprintf("%s expects field on the left side", e.Op))
+	}
+
+	e.Op = strings.ToLower(e.Op)
+
+	_, l, err := p.readAndCheckToken(false, "expected '('", TParentheses)
+	if err != nil {
+		return e, err
+	}
+
+	if l[0] != '(' {
+		return e, p.unexpectedSymbolError(l)
+	}
+
+	e.RN, err = p.parseBlock()
+	if err != nil {
+		return e, err
+	}
+
+	e.RT = VTNode
+	return e, nil
+}
+
+// readOperand reads single value of one of specified tokens and checks it.
+func (p *Parser) readOperand(check func(Token, []byte) error, tokens ...Token) ([]byte, ValueType, error) {
+	t, l, err := p.readAndCheckToken(false, "unexpected end of expression", tokens...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if check != nil {
+		err = check(t, l)
+		if err != nil {
+			return nil, 0, p.positionError(err.Error())
+		}
+	}
+
+	return p.tokenValue(t, l)
+}
+
+// readOperandOrArray reads single value or array of values of
+// specified tokens and checks them.
+func (p *Parser) readOperandOrArray(check func(Token, []byte) error, tokens ...Token) ([]byte, ValueType, error) {
+	t, l, err := p.readAndCheckToken(false, "unexpected end of expression", append(tokens, TParentheses)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if t == TParentheses {
+		if l[0] != '[' {
+			return nil, 0, p.unexpectedSymbolError(l)
+		}
+
+		return p.readArrayElements(func(et Token, el []byte) error {
+			if !token(et, tokens...) {
+				return fmt.Errorf("unexpected symbol %s", el)
+			}
+
+			return check(et, el)
+		})
+	}
+
+	err = check(t, l)
+	if err != nil {
+		return nil, 0, p.positionError(err.Error())
+	}
+
+	return p.tokenValue(t, l)
+}
+
+func checkNumber(t Token, l []byte) error {
+	if t != TNumber {
+		return fmt.Errorf("expected number, got %s", l)
+	}
+
+	return nil
+}
+
+func checkSize(t Token, l []byte) error {
+	if t != TNumber {
+		return fmt.Errorf("expected non negative integer, got %s", l)
+	}
+
+	_, vt, err := parseNumber(l)
+	if err != nil || vt != VTInteger || l[0] == '-' {
+		return fmt.Errorf("expected non negative integer, got %s", l)
+	}
+
+	return nil
+}
+
+func checkType(t Token, l []byte) error {
+	if t == TNumber {
+		n, err := strconv.Atoi(string(l))
+		if err != nil || !(n == -1 || n == 127 || (n >= 1 && n <= 19)) {
+			return fmt.Errorf("unknown type number %s", l)
+		}
+
+		return nil
+	}
+
+	name := string(l[1 : len(l)-1])
+	if strings.HasPrefix(name, "$") {
+		// parameter
+		return nil
+	}
+
+	if !typeNames[name] {
+		return fmt.Errorf("unknown type name %s", l)
+	}
+
+	return nil
+}
+
+// readArray reads array of values, check is called for every
+// element if specified.
+func (p *Parser) readArray(check func(Token, []byte) error) ([]byte, ValueType, error) {
+	_, l, err := p.readAndCheckToken(false, "expected '['", TParentheses)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if l[0] != '[' {
+		return nil, 0, p.positionError("expected '['")
+	}
+
+	return p.readArrayElements(check)
+}
+
+// readArrayOrParam reads array of values or single parameter
+// (`$name` or `"$name"`) which value is encoded as array at compile time.
+func (p *Parser) readArrayOrParam(check func(Token, []byte) error) ([]byte, ValueType, error) {
+	t, l, err := p.readAndCheckToken(false, "expected '[' or parameter", TParentheses, TKey, TString)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch {
+	case t == TKey && l[0] == '$':
+		v, vt, err := p.parseParam(l)
+		if err != nil || vt != VTParam {
+			// parameter of macro can be bound to array
+			return v, vt, err
+		}
+
+		if prm, ok := p.params[string(v)]; ok && !prm.Array {
+			return nil, 0, p.positionError(fmt.Sprintf("parameter %s must be declared as array", v))
+		}
+
+		return v, VTArrayParam, nil
+	case t == TString && len(l) > 2 && l[1] == '$':
+		return append([]byte(nil), l[1:len(l)-1]...), VTArrayParam, nil
+	case t != TParentheses:
+		return nil, 0, p.positionError(fmt.Sprintf("expected '[' or parameter, got %s", l))
+	}
+
+	if l[0] != '[' {
+		return nil, 0, p.positionError("expected '['")
+	}
+
+	return p.readArrayElements(check)
+}
+
+// readArrayElements reads array elements after opening bracket.
+func (p *Parser) readArrayElements(check func(Token, []byte) error) ([]byte, ValueType, error) {
+	var buff []byte
+
+	c := uint32(0)
+	buff = binary.BigEndian.AppendUint32(buff, c)
+
+	for {
+		// read value
+		t, l, err := p.readAndCheckToken(false, "unexpected symbol (expected value for array)",
+			append(PrimitiveTypesAndKey, TParentheses)...)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if c == 0 && t == TParentheses && l[0] == ']' {
+			break
+		}
+
+		if t == TParentheses && !compositeStart(t, l) {
+			return nil, 0, p.unexpectedSymbolError(l)
+		}
+
+		if check != nil {
+			err = check(t, l)
+			if err != nil {
+				return nil, 0, p.positionError(err.Error())
+			}
+		}
+
+		buff, err = p.encodeBinaryToken(buff, t, l)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		c++
+
+		// read comma or closing bracket
+		t, l, err = p.readAndCheckToken(false, "unexpected symbol (expected ',' or ']')", TComma, TParentheses)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if t == TComma {
+			continue
+		}
+
+		if t == TParentheses && l[0] == ']' {
+			break
+		}
+
+		return nil, 0, p.unexpectedSymbolError(l)
+	}
+
+	binary.BigEndian.PutUint32(buff, c)
+	return buff, VTArray, nil
+}
+
+// compositeStart reports whether token starts array or document literal.
+func compositeStart(t Token, l []byte) bool {
+	return t == TParentheses && (l[0] == '[' || l[0] == '{')
+}
+
+func checkDocument(t Token, l []byte) error {
+	if l[0] != '{' {
+		return fmt.Errorf("expected document, got %s", l)
+	}
+
+	return nil
+}
+
+// readDocument reads fields of document literal `{street: "Main", no: 5}`
+// after opening brace. Field names may be quoted, values are literals,
+// parameters, arrays or documents. Document is stored as number of fields
+// followed by fields (name length, name, value type, value).
+func (p *Parser) readDocument() ([]byte, ValueType, error) {
+	c := uint32(0)
+	buff := binary.BigEndian.AppendUint32(nil, c)
+
+	for {
+		t, l, err := p.readAndCheckToken(false, "expected field name", TKey, TString, TParentheses)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if t == TParentheses {
+			if c != 0 || l[0] != '}' {
+				return nil, 0, p.unexpectedSymbolError(l)
+			}
+
+			break
+		}
+
+		k := append([]byte(nil), l...)
+		if t == TString || k[0] == '`' {
+			k, err = unquote(k)
+			if err != nil {
+				return nil, 0, p.positionError(err.Error())
+			}
+
+			k = k[1 : len(k)-1]
+		}
+
+		if len(k) == 0 {
+			return nil, 0, p.positionError("empty field name")
+		}
+
+		_, _, err = p.readAndCheckToken(false, "expected ':'", TColon)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		t, l, err = p.readAndCheckToken(false, "unexpected symbol (expected value of field)",
+			append(PrimitiveTypesAndKey, TParentheses)...)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if t == TParentheses && !compositeStart(t, l) {
+			return nil, 0, p.unexpectedSymbolError(l)
+		}
+
+		v, vt, err := p.tokenValue(t, l)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if vt == VTKey {
+			return nil, 0, p.positionError(fmt.Sprintf("field %s expects value, got %s", k, v))
+		}
+
+		buff = binary.BigEndian.AppendUint32(buff, uint32(len(k)))
+		buff = append(buff, k...)
+		buff = p.appendBinaryValue(buff, v, vt)
+
+		c++
+
+		t, l, err = p.readAndCheckToken(false, "unexpected symbol (expected ',' or '}')", TComma, TParentheses)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if t == TComma {
+			continue
+		}
+
+		if l[0] == '}' {
+			break
+		}
+
+		return nil, 0, p.unexpectedSymbolError(l)
+	}
+
+	binary.BigEndian.PutUint32(buff, c)
+	return buff, VTDocument, nil
+}
+
+func (p *Parser) encodeBinaryToken(buff []byte, t Token, l []byte) ([]byte, error) {
+	tv, vt, err := p.tokenValue(t, l)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.appendBinaryValue(buff, tv, vt), nil
+}
+
+// appendBinaryValue appends value type, length (if value has variable length) and value.
+func (p *Parser) appendBinaryValue(buff, v []byte, vt ValueType) []byte {
+	buff = append(buff, byte(vt))
+
+	tl := p.tokenLength(vt, v)
+	if tl != nil {
+		buff = binary.BigEndian.AppendUint32(buff, uint32(*tl))
+	}
+
+	return append(buff, v...)
+}
+
+func (p *Parser) tokenValue(t Token, l []byte) ([]byte, ValueType, error) {
+	var v []byte
+	var vt ValueType
+	var err error
+
+	switch t {
+	case TString:
+		v, err = unquote(l)
+		vt = VTString
+	case TRegex:
+		v, vt = append([]byte(nil), l...), VTRegex
+	case TNumber:
+		v, vt, err = parseNumber(l)
+	case TNumberUnit:
+		var d time.Duration
+		d, err = parseDuration(string(l))
+		v, vt = binary.BigEndian.AppendUint64(nil, uint64(d)), VTDuration
+	case TBool:
+		v, vt = parseBool(l)
+	case TParentheses:
+		switch l[0] {
+		case '[':
+			return p.readArrayElements(nil)
+		case '{':
+			return p.readDocument()
+		}
+
+		return nil, 0, p.unexpectedSymbolError(l)
+	case TKey:
+		switch {
+		case bytes.Equal(l, keyFuncObjectID):
+			v, vt, err = p.parseFuncObjectID()
+		case bytes.Equal(l, keyFuncDate):
+			v, vt, err = p.parseFuncDate()
+		case bytes.Equal(l, keyNull):
+			v, vt = nil, VTNull
+		case literalFuncs[string(l)] != nil:
+			v, vt, err = literalFuncs[string(l)](p)
+		case bytes.HasPrefix(l, []byte("$$")):
+			v, vt = append([]byte(nil), l...), VTVar
+		case l[0] == '$':
+			// errors of parameter declaration have position already
+			return p.parseParam(l)
+		case l[0] == '`':
+			if len(l) == 2 {
+				err = errors.New("empty field name")
+				break
+			}
+
+			v, err = unquote(l)
+			v, vt = v[1:len(v)-1], VTKey
+		default:
+			v, vt, err = append([]byte(nil), l...), VTKey, nil
+		}
+	}
+
+	if err != nil {
+		return nil, 0, p.positionError(err.Error())
+	}
+
+	return v, vt, nil
+}
+
+// unquote decodes JSON escape sequences (and \' in single-quoted string)
+// of quoted literal, quotes are kept.
+func unquote(l []byte) ([]byte, error) {
+	q, body := l[0], l[1:len(l)-1]
+
+	v := make([]byte, 0, len(l))
+	v = append(v, q)
+
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '\\' {
+			v = append(v, c)
+			continue
+		}
+
+		i++
+		if i == len(body) {
+			return nil, errors.New("invalid escape sequence at the end of string")
+		}
+
+		switch c = body[i]; c {
+		case '"', '\\', '/', q:
+			v = append(v, c)
+		case 'b':
+			v = append(v, '\b')
+		case 'f':
+			v = append(v, '\f')
+		case 'n':
+			v = append(v, '\n')
+		case 'r':
+			v = append(v, '\r')
+		case 't':
+			v = append(v, '\t')
+		case 'u':
+			r, err := unquoteRune(body[i+1:])
+			if err != nil {
+				return nil, err
+			}
+
+			i += 4
+
+			if utf16.IsSurrogate(r) {
+				var r2 rune
+
+				if len(body) > i+2 && body[i+1] == '\\' && body[i+2] == 'u' {
+					r2, err = unquoteRune(body[i+3:])
+					if err != nil {
+						return nil, err
+					}
+
+					i += 6
+				}
+
+				r = utf16.DecodeRune(r, r2)
+				if r == utf8.RuneError {
+					return nil, errors.New("invalid surrogate pair in string")
+				}
+			}
+
+			v = utf8.AppendRune(v, r)
+		default:
+			return nil, fmt.Errorf("invalid escape sequence \\%c", c)
+		}
+	}
+
+	return append(v, q), nil
+}
+
+// unquoteRune decodes hex digits of \uXXXX escape sequence.
+func unquoteRune(h []byte) (rune, error) {
+	if len(h) < 4 {
+		return 0, fmt.Errorf("invalid escape sequence \\u%s", h)
+	}
+
+	r, err := strconv.ParseUint(string(h[:4]), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid escape sequence \\u%s", h[:4])
+	}
+
+	return rune(r), nil
+}
+
+func (p *Parser) tokenLength(vt ValueType, l []byte) *int32 {
+	switch vt {
+	case VTString, VTRegex, VTKey, VTParam, VTArrayParam, VTBinary, VTVar, VTArray, VTDocument:
+		len := int32(len(l))
+		return &len
+	case VTObjectID, VTInteger, VTFloat, VTBool, VTDate:
+		return nil
+	}
+
+	return nil
+}
+
+// parseParam parses parameter with optional type declaration
+// `$name:type`, `$name:[type]` and default value `$name:type = value`.
+func (p *Parser) parseParam(l []byte) ([]byte, ValueType, error) {
+	name := string(l)
+
+	bp, bound := p.bound[name]
+	if bound {
+		name = bp.name
+	}
+
+	if p.used != nil && !bound {
+		p.used[name] = true
+	}
+
+	t, _, err := p.peekToken()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if t != TColon {
+		return []byte(name), VTParam, nil
+	}
+
+	_, _, _ = p.nextToken()
+
+	prm := Param{Name: name, loc: p.loc}
+
+	t, l, err = p.readAndCheckToken(false, "expected parameter type", TKey, TParentheses)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if t == TParentheses {
+		if l[0] != '[' {
+			return nil, 0, p.unexpectedSymbolError(l)
+		}
+
+		prm.Array = true
+
+		_, l, err = p.readAndCheckToken(false, "expected parameter type", TKey)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	prm.Type = string(l)
+	if paramTypes[prm.Type] == nil {
+		return nil, 0, p.positionError(fmt.Sprintf("unknown parameter type %s", l))
+	}
+
+	if prm.Array {
+		_, l, err = p.readAndCheckToken(false, "expected ']'", TParentheses)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if l[0] != ']' {
+			return nil, 0, p.unexpectedSymbolError(l)
+		}
+	}
+
+	t, l, err = p.peekToken()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if t == TOp && string(l) == "=" && !p.left {
+		_, _, _ = p.nextToken()
+
+		err = p.parseParamDefault(&prm)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if bound {
+		return p.parseBoundParam(prm, bp.value)
+	}
+
+	err = p.declareParam(prm)
+	if err != nil {
+		return nil, 0, err
 	}
-}
 
-type Parser struct {
-	s *Scanner
+	return []byte(name), VTParam, nil
 }
 
-func (p *Parser) Parse() (*Node, error) {
-	root := &Node{LRoot: true}
-	n := &Node{Op: "and"}
-	root.SetNextNode(n)
-
-	for {
-		var err error
-
-		n, err = p.parse(n)
-		if err != nil {
-			if errors.Is(err, ErrParsed) {
-				r := root.LN
-				r.Parent = nil
+// parseParamDefault reads default value of parameter and converts
+// it to parameter type.
+func (p *Parser) parseParamDefault(prm *Param) error {
+	var v []byte
+	var vt ValueType
+	var err error
 
-				Link(r)
-				r = Reduce(r)
+	if prm.Array {
+		v, vt, err = p.readArray(nil)
+	} else {
+		v, vt, err = p.readOperand(nil, PrimitiveTypesAndKey...)
+	}
 
-				return r, nil
-			}
+	if err != nil {
+		return err
+	}
 
-			return nil, err
-		}
+	lv, err := literalValue(v, vt)
+	if err != nil {
+		return p.positionError(fmt.Sprintf("invalid default of parameter %s: %v", prm.Name, err))
 	}
-}
 
-func (p *Parser) parse(n *Node) (*Node, error) {
-	t, l, err := p.readToken(true, "")
+	prm.Default, err = prm.Convert(lv)
 	if err != nil {
-		return nil, err
+		return p.positionError(fmt.Sprintf("invalid default: %v", err))
 	}
 
-	switch {
-	case IsPrimitiveOrKey(t):
-		switch {
-		case bytes.EqualFold(l, keyAnd):
-			if n.L == nil && n.LN == nil {
-				return nil, p.unexpectedSymbolError(l)
-			}
+	prm.HasDefault = true
+	return nil
+}
+
+// parseBoundParam reads literal bound to declared parameter of macro
+// and checks it against declaration.
+func (p *Parser) parseBoundParam(prm Param, value []macroToken) ([]byte, ValueType, error) {
+	if p.backTok != 0 {
+		p.queue = append([]macroToken{{t: p.backTok, l: []byte(string(p.backLit))}}, p.queue...)
+		p.backTok = 0
+	}
 
-			newN := &Node{Op: "and"}
-			n.SetNextNode(newN)
-			return newN, nil
+	rest := len(p.queue)
+	p.queue = append(value[:len(value):len(value)], p.queue...)
 
-		case bytes.EqualFold(l, keyOr):
-			if n.L == nil && n.LN == nil {
-				return nil, p.unexpectedSymbolError(l)
-			}
+	var v []byte
+	var vt ValueType
+	var err error
 
-			r, left := n.LocalRoot()
+	if prm.Array {
+		v, vt, err = p.readArray(nil)
+	} else {
+		v, vt, err = p.readOperand(nil, PrimitiveTypesAndKey...)
+	}
 
-			rp := r.RN
-			if left {
-				rp = r.LN
-			}
+	if err != nil {
+		return nil, 0, err
+	}
 
-			newN := &Node{Op: "or"}
-			rp.ReplaceNode(newN)
-			newN.SetNextNode(rp)
+	left := len(p.queue)
+	if p.backTok != 0 {
+		left++
+	}
 
-			return newN, nil
-		}
+	lv, err := literalValue(v, vt)
+	if err == nil && left != rest {
+		err = errors.New("literal expected")
+	}
 
-		e, err := p.parseExpression(t, l)
-		if err != nil {
-			return nil, err
-		}
+	var cv interface{}
+	if err == nil {
+		cv, err = prm.Convert(lv)
+	}
 
-		n.SetNextExpression(&e)
-		return n, nil
+	if err != nil {
+		return nil, 0, p.positionError(fmt.Sprintf("invalid value of parameter %s: %v", prm.Name, err))
+	}
 
-	case t == TParentheses:
-		if l[0] == ')' {
-			if n.Parent.Parent == nil {
-				return nil, p.unexpectedSymbolError(l)
-			}
+	v, vt = p.convertedLiteral(cv)
 
-			n, _ = n.Parent.LocalRoot()
+	return v, vt, nil
+}
 
-			newN := &Node{Op: "and"}
-			n.ReplaceNode(newN)
-			newN.SetNextNode(n)
+// convertedLiteral returns literal of value converted to parameter type
+// (see Param.Convert).
+func (p *Parser) convertedLiteral(cv interface{}) ([]byte, ValueType) {
+	switch tv := cv.(type) {
+	case int32:
+		return binary.BigEndian.AppendUint32(nil, uint32(tv)), VTInt32
+	case int64:
+		return binary.BigEndian.AppendUint64(nil, uint64(tv)), VTInt64
+	case float64:
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(tv)), VTFloat
+	case primitive.Decimal128:
+		h, l := tv.GetBytes()
+		return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, h), l), VTDecimal
+	case string:
+		return []byte(`"` + tv + `"`), VTString
+	case bool:
+		if tv {
+			return []byte{1}, VTBool
+		}
 
-			return newN, nil
+		return []byte{0}, VTBool
+	case time.Time:
+		return binary.BigEndian.AppendUint64(nil, uint64(primitive.NewDateTimeFromTime(tv))), VTDate
+	case primitive.DateTime:
+		return binary.BigEndian.AppendUint64(nil, uint64(tv)), VTDate
+	case time.Duration:
+		return binary.BigEndian.AppendUint64(nil, uint64(tv)), VTDuration
+	case primitive.ObjectID:
+		return tv[:], VTObjectID
+	case bson.A:
+		buff := binary.BigEndian.AppendUint32(nil, uint32(len(tv)))
+
+		for _, ev := range tv {
+			v, vt := p.convertedLiteral(ev)
+			buff = p.appendBinaryValue(buff, v, vt)
 		}
 
-		newN := &Node{Op: "and"}
-		n.SetNextNode(newN)
-		n.LRoot = true
-		return newN, nil
+		return buff, VTArray
 	}
 
-	return nil, p.unexpectedSymbolError(l)
+	return nil, VTNull
 }
 
-func token(t Token, in ...Token) bool {
-	for _, tin := range in {
-		if tin == t {
-			return true
-		}
+// declareParam records parameter declaration, parameter can be declared
+// several times but with the same type and default.
+func (p *Parser) declareParam(prm Param) error {
+	if p.params == nil {
+		p.params = make(map[string]Param)
 	}
 
-	return false
+	prev, ok := p.params[prm.Name]
+	if ok && !prev.same(prm) {
+		return p.positionError(fmt.Sprintf("parameter %s redeclared", prm.Name))
+	}
+
+	p.params[prm.Name] = prm
+	return nil
 }
 
-func (p *Parser) readToken(canBeEnd bool, unexpected string) (Token, []byte, error) {
-	err := p.s.Next()
-	if err != nil {
-		if canBeEnd && errors.Is(err, io.EOF) {
-			if canBeEnd {
-				return 0, nil, ErrParsed
-			}
+// literalFuncs are constructors of extended BSON literals
+// (in addition to ISODate and ObjectId).
+var literalFuncs = map[string]func(p *Parser) ([]byte, ValueType, error){
+	"NumberDecimal": (*Parser).parseFuncDecimal,
+	"NumberInt":     (*Parser).parseFuncInt,
+	"NumberLong":    (*Parser).parseFuncLong,
+	"UUID":          (*Parser).parseFuncUUID,
+	"BinData":       (*Parser).parseFuncBinData,
+	"Timestamp":     (*Parser).parseFuncTimestamp,
+	"MinKey":        (*Parser).parseFuncMinKey,
+	"MaxKey":        (*Parser).parseFuncMaxKey,
+}
 
-			return 0, nil, p.positionError(unexpected)
-		}
+// readParenthesis reads opening or closing parenthesis of literal.
+func (p *Parser) readParenthesis(c byte) error {
+	_, l, err := p.readAndCheckToken(false, "unexpected end of script", TParentheses)
+	if err != nil {
+		return err
+	}
 
-		return 0, nil, err
+	if l[0] != c {
+		return p.unexpectedSymbolError(l)
 	}
 
-	t, l := p.s.Token()
-	return t, l, nil
+	return nil
 }
 
-func (p *Parser) readAndCheckToken(canBeEnd bool, unexpected string, tokens ...Token) (Token, []byte, error) {
-	err := p.s.Next()
+// readLiteralArg reads number (with optional minus) or string
+// argument of literal and returns it without quotes.
+func (p *Parser) readLiteralArg() (string, error) {
+	t, l, err := p.readAndCheckToken(false, "unexpected end of script", TNumber, TString, TArith)
 	if err != nil {
-		if canBeEnd && errors.Is(err, io.EOF) {
-			if canBeEnd {
-				return 0, nil, ErrParsed
-			}
+		return "", err
+	}
 
-			return 0, nil, p.positionError(unexpected)
+	switch t {
+	case TString:
+		return string(l[1 : len(l)-1]), nil
+	case TArith:
+		if l[0] != '-' {
+			return "", p.unexpectedSymbolError(l)
 		}
 
-		return 0, nil, err
-	}
+		_, l, err = p.readAndCheckToken(false, "unexpected end of script", TNumber)
+		if err != nil {
+			return "", err
+		}
 
-	t, l := p.s.Token()
-	if !token(t, tokens...) {
-		return 0, nil, p.unexpectedSymbolError(l)
+		return "-" + string(l), nil
 	}
 
-	return t, l, nil
+	return string(l), nil
 }
 
-func (p *Parser) parseExpression(startT Token, startL []byte) (Expression, error) {
-	var e Expression
-	var err error
-
-	e.L, e.LT, err = p.tokenValue(startT, startL)
+// parseFuncArgs reads arguments of literal `(a, b, ...)`.
+func (p *Parser) parseFuncArgs(n int) ([]string, error) {
+	err := p.readParenthesis('(')
 	if err != nil {
-		return e, err
+		return nil, err
 	}
 
-	// e.S = p.s.Position()
-
-	_, l, err := p.readAndCheckToken(false, "unexpected end of expression", TOp, TKey)
-	if err != nil {
-		return e, err
-	}
+	args := make([]string, n)
 
-	e.Op = string(l)
+	for i := range args {
+		if i > 0 {
+			_, _, err = p.readAndCheckToken(false, "expected ','", TComma)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	if e.Op == "$in" {
-		v, vt, err := p.readArray()
+		args[i], err = p.readLiteralArg()
 		if err != nil {
-			return e, err
+			return nil, err
 		}
-
-		e.R, e.RT = v, vt
-		return e, nil
 	}
 
-	t, l, err := p.readAndCheckToken(false, "unexpected end of expression", PrimitiveTypesAndKey...)
+	return args, p.readParenthesis(')')
+}
+
+func (p *Parser) parseFuncDecimal() ([]byte, ValueType, error) {
+	args, err := p.parseFuncArgs(1)
 	if err != nil {
-		return e, err
+		return nil, 0, err
 	}
 
-	e.R, e.RT, err = p.tokenValue(t, l)
+	d, err := primitive.ParseDecimal128(args[0])
 	if err != nil {
-		return e, err
+		return nil, 0, fmt.Errorf("invalid decimal %s", args[0])
 	}
 
-	return e, nil
+	h, l := d.GetBytes()
+	v := binary.BigEndian.AppendUint64(nil, h)
+	return binary.BigEndian.AppendUint64(v, l), VTDecimal, nil
 }
 
-func (p *Parser) readArray() ([]byte, ValueType, error) {
-	var buff []byte
-
-	_, l, err := p.readAndCheckToken(false, "expected '['", TParentheses)
+func (p *Parser) parseFuncInt() ([]byte, ValueType, error) {
+	args, err := p.parseFuncArgs(1)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	if l[0] != '[' {
-		return nil, 0, p.positionError("expected '['")
+	i, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid int %s", args[0])
 	}
 
-	c := uint32(0)
-	buff = binary.BigEndian.AppendUint32(buff, c)
-
-	for {
-		// read value
-		t, l, err := p.readAndCheckToken(false, "unexpected symbol (expected value for array)", PrimitiveTypesAndKey...)
-		if err != nil {
-			return nil, 0, err
-		}
-
-		buff, err = p.encodeBinaryToken(buff, t, l)
-		if err != nil {
-			return nil, 0, err
-		}
+	return binary.BigEndian.AppendUint32(nil, uint32(i)), VTInt32, nil
+}
 
-		c++
+func (p *Parser) parseFuncLong() ([]byte, ValueType, error) {
+	args, err := p.parseFuncArgs(1)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		// read comma or closing bracket
-		t, l, err = p.readAndCheckToken(false, "unexpected symbol (expected ',' or ']')", TComma, TParentheses)
-		if err != nil {
-			return nil, 0, err
-		}
+	i, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid long %s", args[0])
+	}
 
-		if t == TComma {
-			continue
-		}
+	return binary.BigEndian.AppendUint64(nil, uint64(i)), VTInt64, nil
+}
 
-		if t == TParentheses && l[0] == ']' {
-			break
-		}
+func (p *Parser) parseFuncUUID() ([]byte, ValueType, error) {
+	args, err := p.parseFuncArgs(1)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		return nil, 0, p.unexpectedSymbolError(l)
+	h, err := hex.DecodeString(strings.ReplaceAll(args[0], "-", ""))
+	if err != nil || len(h) != 16 {
+		return nil, 0, fmt.Errorf("invalid uuid %s", args[0])
 	}
 
-	binary.BigEndian.PutUint32(buff, c)
-	return buff, VTArray, nil
+	return h, VTUUID, nil
 }
 
-func (p *Parser) encodeBinaryToken(buff []byte, t Token, l []byte) ([]byte, error) {
-	tv, vt, err := p.tokenValue(t, l)
+// parseFuncBinData parses `BinData(subtype, "base64")`,
+// value is stored as subtype byte followed by data.
+func (p *Parser) parseFuncBinData() ([]byte, ValueType, error) {
+	args, err := p.parseFuncArgs(2)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	buff = append(buff, byte(vt))
+	st, err := strconv.ParseUint(args[0], 10, 8)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid binary subtype %s", args[0])
+	}
 
-	tl := p.tokenLength(vt, tv)
-	if tl != nil {
-		buff = binary.BigEndian.AppendUint32(buff, uint32(*tl))
+	data, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid base64 %s", args[1])
 	}
 
-	return append(buff, tv...), nil
+	return append([]byte{byte(st)}, data...), VTBinary, nil
 }
 
-func (p *Parser) tokenValue(t Token, l []byte) ([]byte, ValueType, error) {
-	var v []byte
-	var vt ValueType
-	var err error
+func (p *Parser) parseFuncTimestamp() ([]byte, ValueType, error) {
+	args, err := p.parseFuncArgs(2)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	switch t {
-	case TString:
-		v, vt = append([]byte(nil), l...), VTString
-	case TRegex:
-		v, vt = append([]byte(nil), l...), VTRegex
-	case TNumber:
-		v, vt, err = parseNumber(l)
-	case TBool:
-		v, vt = parseBool(l)
-	case TKey:
-		switch {
-		case bytes.Equal(l, keyFuncObjectID):
-			v, vt, err = p.parseFuncObjectID()
-		case bytes.Equal(l, keyFuncDate):
-			v, vt, err = p.parseFuncDate()
-		default:
-			v, vt, err = append([]byte(nil), l...), VTKey, nil
+	v := make([]byte, 0, 8)
+
+	for _, a := range args {
+		u, err := strconv.ParseUint(a, 10, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid timestamp %s", a)
 		}
-	}
 
-	if err != nil {
-		return nil, 0, p.positionError(err.Error())
+		v = binary.BigEndian.AppendUint32(v, uint32(u))
 	}
 
-	return v, vt, nil
+	return v, VTTimestamp, nil
 }
 
-func (p *Parser) tokenLength(vt ValueType, l []byte) *int32 {
-	switch vt {
-	case VTString, VTRegex, VTKey:
-		len := int32(len(l))
-		return &len
-	case VTObjectID, VTInteger, VTFloat, VTBool, VTDate:
+func (p *Parser) parseFuncMinKey() ([]byte, ValueType, error) {
+	return nil, VTMinKey, p.readOptionalParentheses()
+}
+
+func (p *Parser) parseFuncMaxKey() ([]byte, ValueType, error) {
+	return nil, VTMaxKey, p.readOptionalParentheses()
+}
+
+// readOptionalParentheses reads `()` after literal if present,
+// so both `MinKey` and `MinKey()` are valid.
+func (p *Parser) readOptionalParentheses() error {
+	t, l, err := p.peekToken()
+	if err != nil {
+		return err
+	}
+
+	if t != TParentheses || l[0] != '(' {
 		return nil
 	}
 
-	return nil
+	_, _, _ = p.nextToken()
+
+	return p.readParenthesis(')')
 }
 
 func (p *Parser) parseFuncObjectID() ([]byte, ValueType, error) {
@@ -386,7 +3024,7 @@ func (p *Parser) parseFuncDate() ([]byte, ValueType, error) {
 		return nil, 0, fmt.Errorf("unexpected %s", cp)
 	}
 
-	dt, err := time.Parse(time.RFC3339Nano, dts)
+	dt, err := parseDate(dts, p.loc)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -394,24 +3032,130 @@ func (p *Parser) parseFuncDate() ([]byte, ValueType, error) {
 	return binary.BigEndian.AppendUint64(nil, uint64(dt.UnixMilli())), VTDate, nil
 }
 
+// localDateLayouts are date layouts without offset.
+var localDateLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// parseDate parses RFC3339 date or date without offset (date only,
+// year and month or year) in loc.
+func parseDate(s string, loc *time.Location) (time.Time, error) {
+	dt, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return dt, nil
+	}
+
+	for _, layout := range localDateLayouts {
+		dt, lerr := time.ParseInLocation(layout, s, loc)
+		if lerr == nil {
+			return dt, nil
+		}
+	}
+
+	return dt, err
+}
+
+var (
+	decimalLiteral = regexp.MustCompile(`^[+-]?(\d(_?\d)*(\.(\d(_?\d)*)?)?|\.\d(_?\d)*)([eE][+-]?\d(_?\d)*)?$`)
+	hexLiteral     = regexp.MustCompile(`^[+-]?0[xX][0-9a-fA-F](_?[0-9a-fA-F])*$`)
+)
+
+// parseNumber parses number literal. Integer literals (decimal or hex)
+// must fit int64, literals with fraction or exponent are doubles.
+// Digits may be separated by underscore: 1_000_000.
 func parseNumber(l []byte) ([]byte, ValueType, error) {
-	if bytes.Contains(l, []byte{'.'}) {
-		f, err := strconv.ParseFloat(string(l), 64)
+	hex := hexLiteral.Match(l)
+	if !hex && !decimalLiteral.Match(l) {
+		return nil, 0, fmt.Errorf("invalid number %s", l)
+	}
+
+	ns := strings.ReplaceAll(string(l), "_", "")
+
+	if !hex && strings.ContainsAny(ns, ".eE") {
+		f, err := strconv.ParseFloat(ns, 64)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, fmt.Errorf("number %s is out of range of double", l)
 		}
 
 		return binary.BigEndian.AppendUint64(nil, math.Float64bits(f)), VTFloat, nil
 	}
 
-	n, err := strconv.Atoi(string(l))
+	// leading zeros do not make literal octal
+	base := 10
+	if hex {
+		i := strings.IndexAny(ns, "xX")
+		ns, base = ns[:i-1]+ns[i+1:], 16
+	}
+
+	n, err := strconv.ParseInt(ns, base, 64)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, fmt.Errorf("integer %s is out of range of int64", l)
 	}
 
 	return binary.BigEndian.AppendUint64(nil, uint64(n)), VTInteger, nil
 }
 
+var (
+	durationLiteral = regexp.MustCompile(`^[+-]?(\d+(\.\d+)?(ms|s|m|h|d|w))+$`)
+	durationPart    = regexp.MustCompile(`(\d+(?:\.\d+)?)(ms|s|m|h|d|w)`)
+)
+
+// durationUnits are units of duration literal.
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// parseDuration parses duration literal like 7d, 1h30m or -1.5h.
+func parseDuration(s string) (time.Duration, error) {
+	if !durationLiteral.MatchString(s) {
+		return 0, fmt.Errorf("invalid duration %s", s)
+	}
+
+	var d float64
+
+	for _, m := range durationPart.FindAllStringSubmatch(s, -1) {
+		n, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+
+		d += n * float64(durationUnits[m[2]])
+	}
+
+	if d > math.MaxInt64 {
+		return 0, fmt.Errorf("duration %s is out of range", s)
+	}
+
+	if s[0] == '-' {
+		d = -d
+	}
+
+	return time.Duration(d), nil
+}
+
+// parseFloat parses number literal as float64.
+func parseFloat(l []byte) (float64, error) {
+	v, vt, err := parseNumber(l)
+	if err != nil {
+		return 0, err
+	}
+
+	if vt == VTInteger {
+		return float64(int64(binary.BigEndian.Uint64(v))), nil
+	}
+
+	return math.Float64frombits(binary.BigEndian.Uint64(v)), nil
+}
+
 func parseBool(l []byte) ([]byte, ValueType) {
 	if l[0] == 't' || l[0] == 'T' {
 		return []byte{1}, VTBool
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -82,13 +83,7 @@ func TestParser_Parse(t *testing.T) {
 			want: &query.Node{
 				Op: "and",
 				L:  keyExpString(">", "a", `"90"`),
-				R: &query.Expression{
-					Op: "=",
-					L:  []byte("\"don\""),
-					LT: query.VTString,
-					R:  []byte("d"),
-					RT: query.VTKey,
-				},
+				R:  keyExpString("=", "d", `"don"`),
 			},
 		},
 		{
@@ -99,13 +94,7 @@ func TestParser_Parse(t *testing.T) {
 				LN: &query.Node{
 					Op: "and",
 					L:  keyExpString(">", "a", `"90"`),
-					R: &query.Expression{
-						Op: "=",
-						L:  []byte("\"don\""),
-						LT: query.VTString,
-						R:  []byte("d"),
-						RT: query.VTKey,
-					},
+					R:  keyExpString("=", "d", `"don"`),
 				},
 				R: keyExp("=", "c", []byte("e"), query.VTKey),
 			},
@@ -118,14 +107,8 @@ func TestParser_Parse(t *testing.T) {
 				L:  keyExpString(">", "a", `"90"`),
 				RN: &query.Node{
 					Op: "or",
-					L: &query.Expression{
-						Op: "=",
-						L:  []byte("\"don\""),
-						LT: query.VTString,
-						R:  []byte("d"),
-						RT: query.VTKey,
-					},
-					R: keyExp("=", "c", []byte("e"), query.VTKey),
+					L:  keyExpString("=", "d", `"don"`),
+					R:  keyExp("=", "c", []byte("e"), query.VTKey),
 				},
 			},
 		},
@@ -137,13 +120,7 @@ func TestParser_Parse(t *testing.T) {
 				LN: &query.Node{
 					Op: "and",
 					L:  keyExpString(">", "a", `"90"`),
-					R: &query.Expression{
-						Op: "=",
-						L:  []byte("\"don\""),
-						LT: query.VTString,
-						R:  []byte("d"),
-						RT: query.VTKey,
-					},
+					R:  keyExpString("=", "d", `"don"`),
 				},
 				R: keyExp("=", "c", []byte("e"), query.VTKey),
 			},
@@ -177,6 +154,230 @@ func TestParser_Parse(t *testing.T) {
 				L:  keyExp("$exists", "a", []byte{1}, query.VTBool),
 			},
 		},
+		{
+			name:       "not",
+			expression: "not a = 1",
+			want: &query.Node{
+				Op: "not",
+				L:  keyExpByte("=", "a", 1),
+			},
+		},
+		{
+			name:       "not and",
+			expression: "NOT a = 1 and b = 1",
+			want: &query.Node{
+				Op: "and",
+				LN: &query.Node{
+					Op: "not",
+					L:  keyExpByte("=", "a", 1),
+				},
+				R: keyExpByte("=", "b", 1),
+			},
+		},
+		{
+			name:       "not with brackets",
+			expression: "a = 1 or not (b = 1 or c = 1)",
+			want: &query.Node{
+				Op: "or",
+				L:  keyExpByte("=", "a", 1),
+				RN: &query.Node{
+					Op: "not",
+					LN: &query.Node{
+						Op: "or",
+						L:  keyExpByte("=", "b", 1),
+						R:  keyExpByte("=", "c", 1),
+					},
+				},
+			},
+		},
+		{
+			name:       "not with exclamation mark",
+			expression: "!(b = 1 or c = 1)",
+			want: &query.Node{
+				Op: "not",
+				LN: &query.Node{
+					Op: "or",
+					L:  keyExpByte("=", "b", 1),
+					R:  keyExpByte("=", "c", 1),
+				},
+			},
+		},
+		{
+			name:       "double not",
+			expression: "not not a = 1",
+			want: &query.Node{
+				Op: "and",
+				L:  keyExpByte("=", "a", 1),
+			},
+		},
+		{
+			name:       "not without operand",
+			expression: "a = 1 and not",
+			wantErr:    true,
+		},
+		{
+			name:       "any",
+			expression: "items ANY (a = 1 or b = 1) and c = 1",
+			want: &query.Node{
+				Op: "and",
+				L: &query.Expression{
+					Op: "any",
+					L:  []byte("items"),
+					LT: query.VTKey,
+					RT: query.VTNode,
+					RN: &query.Node{
+						Op: "or",
+						L:  keyExpByte("=", "a", 1),
+						R:  keyExpByte("=", "b", 1),
+					},
+				},
+				R: keyExpByte("=", "c", 1),
+			},
+		},
+		{
+			name:       "unclosed block",
+			expression: "items all (a = 1",
+			wantErr:    true,
+		},
+		{
+			name:       "empty block",
+			expression: "items none ()",
+			wantErr:    true,
+		},
+		{
+			name:       "unexpected closing parenthesis",
+			expression: "a = 1 and b = 1)",
+			wantErr:    true,
+		},
+		{
+			name:       "and binds tighter than or",
+			expression: "a = 1 or b = 1 and c = 1",
+			want: &query.Node{
+				Op: "or",
+				L:  keyExpByte("=", "a", 1),
+				RN: &query.Node{
+					Op: "and",
+					L:  keyExpByte("=", "b", 1),
+					R:  keyExpByte("=", "c", 1),
+				},
+			},
+		},
+		{
+			name:       "left associative or",
+			expression: "a = 1 or b = 1 or c = 1",
+			want: &query.Node{
+				Op: "or",
+				LN: &query.Node{
+					Op: "or",
+					L:  keyExpByte("=", "a", 1),
+					R:  keyExpByte("=", "b", 1),
+				},
+				R: keyExpByte("=", "c", 1),
+			},
+		},
+		{
+			name:       "reversed operands",
+			expression: "5 < a",
+			want: &query.Node{
+				Op: "and",
+				L:  keyExpByte(">", "a", 5),
+			},
+		},
+		{
+			name:       "missing and",
+			expression: "a = 1 b = 1",
+			wantErr:    true,
+		},
+		{
+			name:       "double or",
+			expression: "a = 1 or or b = 1",
+			wantErr:    true,
+		},
+		{
+			name:       "trailing and",
+			expression: "a = 1 and",
+			wantErr:    true,
+		},
+		{
+			name:       "leading or",
+			expression: "or a = 1",
+			wantErr:    true,
+		},
+		{
+			name:       "group without and",
+			expression: "(a = 1) (b = 1)",
+			wantErr:    true,
+		},
+		{
+			name:       "calculated operand",
+			expression: "price * (qty + 1) > size(tags)",
+			want: &query.Node{
+				Op: "and",
+				L: &query.Expression{
+					Op: ">",
+					LT: query.VTCalc,
+					LC: &query.Calc{
+						Op: "*",
+						Args: []*query.Calc{
+							{V: []byte("price"), VT: query.VTKey},
+							{Op: "+", Args: []*query.Calc{
+								{V: []byte("qty"), VT: query.VTKey},
+								{V: []byte{0, 0, 0, 0, 0, 0, 0, 1}, VT: query.VTInteger},
+							}},
+						},
+					},
+					RT: query.VTCalc,
+					RC: &query.Calc{
+						Op: "size",
+						Args: []*query.Calc{
+							{V: []byte("tags"), VT: query.VTKey},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:       "not in parameter",
+			expression: "status NOT IN $statuses",
+			want: &query.Node{
+				Op: "and",
+				L:  keyExp("$nin", "status", []byte("$statuses"), query.VTArrayParam),
+			},
+		},
+		{
+			name:       "near",
+			expression: "loc NEAR point(-73.5, 40) WITHIN 2km",
+			want: &query.Node{
+				Op: "and",
+				L: &query.Expression{
+					Op: "$near",
+					L:  []byte("loc"),
+					LT: query.VTKey,
+					RT: query.VTGeo,
+					G: &query.Geo{
+						Type:   "Point",
+						Coords: [][2]float64{{-73.5, 40}},
+						Dist:   []byte{0x40, 0x9f, 0x40, 0, 0, 0, 0, 0},
+						DistT:  query.VTFloat,
+					},
+				},
+			},
+		},
+		{
+			name:       "near polygon",
+			expression: "loc NEAR polygon([[0, 0], [1, 0], [1, 1]])",
+			wantErr:    true,
+		},
+		{
+			name:       "unknown function",
+			expression: "foo(a) > 1",
+			wantErr:    true,
+		},
+		{
+			name:       "wrong number of arguments",
+			expression: "size(a, b) > 1",
+			wantErr:    true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -190,6 +391,10 @@ func TestParser_Parse(t *testing.T) {
 				return
 			}
 
+			if tt.wantErr {
+				return
+			}
+
 			tt.want.FixParent()
 			err = compareNodes(tt.want, got)
 			if err != nil {
@@ -261,6 +466,41 @@ func TestParser_ParseAndLink(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:       "between",
+			expression: "a between 1 and 5",
+			want: &query.Node{
+				Op: "and",
+				L: &query.Expression{
+					Op: ">=",
+					L:  []byte("a"),
+					LT: query.VTKey,
+					R:  []byte{0, 0, 0, 0, 0, 0, 0, 1},
+					RT: query.VTInteger,
+					Links: &[]*query.Expression{
+						keyExpByte("<=", "a", 5),
+					},
+				},
+			},
+		},
+		{
+			name:       "chained comparison",
+			expression: "1 < a <= 5 and a != 3",
+			want: &query.Node{
+				Op: "and",
+				L: &query.Expression{
+					Op: ">",
+					L:  []byte("a"),
+					LT: query.VTKey,
+					R:  []byte{0, 0, 0, 0, 0, 0, 0, 1},
+					RT: query.VTInteger,
+					Links: &[]*query.Expression{
+						keyExpByte("<=", "a", 5),
+						keyExpByte("!=", "a", 3),
+					},
+				},
+			},
+		},
 		{
 			name:       "link in brackets",
 			expression: "(a > 90 and a < 100) or a = 25",
@@ -315,6 +555,161 @@ func TestParser_ParseAndLink(t *testing.T) {
 	}
 }
 
+// TestParser_Equivalence checks that queries written in different
+// ways are parsed to the same tree.
+func TestParser_Equivalence(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		equivalent string
+	}{
+		{
+			name:       "and before or",
+			expression: "a = 1 and b = 1 or c = 1",
+			equivalent: "(a = 1 and b = 1) or c = 1",
+		},
+		{
+			name:       "and after or",
+			expression: "a = 1 or b = 1 and c = 1",
+			equivalent: "a = 1 or (b = 1 and c = 1)",
+		},
+		{
+			name:       "and between or",
+			expression: "a = 1 or b = 1 and c = 1 or d = 1",
+			equivalent: "(a = 1 or (b = 1 and c = 1)) or d = 1",
+		},
+		{
+			name:       "or associativity",
+			expression: "a = 1 or b = 1 or c = 1",
+			equivalent: "(a = 1 or b = 1) or c = 1",
+		},
+		{
+			name:       "and associativity",
+			expression: "a = 1 and b = 1 and c = 1",
+			equivalent: "(a = 1 and b = 1) and c = 1",
+		},
+		{
+			name:       "not before and",
+			expression: "not a = 1 and b = 1",
+			equivalent: "(not a = 1) and b = 1",
+		},
+		{
+			name:       "not before or",
+			expression: "! a = 1 or b = 1",
+			equivalent: "(not (a = 1)) or b = 1",
+		},
+		{
+			name:       "double not",
+			expression: "a = 1 and not !b = 1",
+			equivalent: "a = 1 and b = 1",
+		},
+		{
+			name:       "redundant parentheses",
+			expression: "((a = 1)) and (((b = 1 or c = 1)))",
+			equivalent: "a = 1 and (b = 1 or c = 1)",
+		},
+		{
+			name:       "keywords case",
+			expression: "a = 1 AND NOT b = 1 Or c = 1",
+			equivalent: "a = 1 and not b = 1 or c = 1",
+		},
+		{
+			name:       "reversed comparison",
+			expression: `5 < a and 10 >= b and "x" != c and $p = d`,
+			equivalent: `a > 5 and b <= 10 and c != "x" and d = $p`,
+		},
+		{
+			name:       "reversed chain",
+			expression: "1 < a <= 5",
+			equivalent: "a > 1 and a <= 5",
+		},
+		{
+			name:       "array in group",
+			expression: "(a in [1, 2] or b = {c: 1}) and c = 1",
+			equivalent: "(a in [1, 2] or b = {c: 1}) and (c = 1)",
+		},
+		{
+			name:       "quantifier block",
+			expression: "items ANY (a = 1 or b = 1 and c = 1)",
+			equivalent: "items ANY (a = 1 or (b = 1 and c = 1))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := query.NewParser(query.NewScanner(strings.NewReader(tt.equivalent))).Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := query.NewParser(query.NewScanner(strings.NewReader(tt.expression))).Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = compareNodes(want, got)
+			if err != nil {
+				t.Log("want", want.String())
+				t.Log("got", got.String())
+				t.Error("Parser.Parse() not equivalent", err)
+			}
+		})
+	}
+}
+
+func TestParser_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       string
+	}{
+		{
+			name:       "parameter redeclared",
+			expression: "a = $x:int and b = $x:long",
+			want:       "parameter $x redeclared: line 1; column 27",
+		},
+		{
+			name:       "unknown parameter type",
+			expression: "a = $x:foo",
+			want:       "unknown parameter type foo: line 1; column 11",
+		},
+		{
+			name:       "position after comment",
+			expression: "/* привет */ a = $x:foo",
+			want:       "unknown parameter type foo: line 1; column 24",
+		},
+		{
+			name:       "position after comment in the middle",
+			expression: "a = 1 /* ä\n ö */ and b = $x:foo",
+			want:       "unknown parameter type foo: line 2; column 21",
+		},
+		{
+			name:       "chain without field",
+			expression: "a < 1 < 2",
+			want:       "comparison < has no field: line 1; column 10",
+		},
+		{
+			name:       "comparison of values",
+			expression: "a = 1 and 1 < 2",
+			want:       "comparison < has no field: line 1; column 16",
+		},
+		{
+			name:       "macro name at the end",
+			expression: "a = 1 and @",
+			want:       "macro name expected after @: line 1; column 12",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := query.NewParser(query.NewScanner(strings.NewReader(tt.expression))).Parse()
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Parser.Parse() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
 func compareNodes(a, b *query.Node) error {
 	if a == nil && b == nil {
 		return nil
@@ -380,6 +775,29 @@ func compareExpressions(a, b *query.Expression) error {
 		return fmt.Errorf("right lexeme mismatch %s with %s", a, b)
 	}
 
+	err := compareNodes(a.RN, b.RN)
+	if err != nil {
+		return fmt.Errorf("right node mismatch %s with %s: %w", a, b, err)
+	}
+
+	err = compareCalcs(a.LC, b.LC)
+	if err != nil {
+		return fmt.Errorf("left operand mismatch %s with %s: %w", a, b, err)
+	}
+
+	err = compareCalcs(a.RC, b.RC)
+	if err != nil {
+		return fmt.Errorf("right operand mismatch %s with %s: %w", a, b, err)
+	}
+
+	if !reflect.DeepEqual(a.G, b.G) {
+		return fmt.Errorf("geometry mismatch %s with %s", a, b)
+	}
+
+	if !reflect.DeepEqual(a.Cal, b.Cal) {
+		return fmt.Errorf("calendar mismatch %s with %s", a, b)
+	}
+
 	if (a.Links == nil) != (b.Links == nil) {
 		return fmt.Errorf("links nil not nil %s - %s", a, b)
 	}
@@ -399,3 +817,30 @@ func compareExpressions(a, b *query.Expression) error {
 
 	return nil
 }
+
+func compareCalcs(a, b *query.Calc) error {
+	if a == nil && b == nil {
+		return nil
+	}
+
+	if a == nil || b == nil {
+		return fmt.Errorf("nil not nil %s - %s", a, b)
+	}
+
+	if a.Op != b.Op || a.VT != b.VT || !bytes.Equal(a.V, b.V) {
+		return fmt.Errorf("operand mismatch %s with %s", a, b)
+	}
+
+	if len(a.Args) != len(b.Args) {
+		return fmt.Errorf("arguments mismatch %s with %s", a, b)
+	}
+
+	for i := range a.Args {
+		err := compareCalcs(a.Args[i], b.Args[i])
+		if err != nil {
+			return fmt.Errorf("arguments mismatch %s with %s: %w", a, b, err)
+		}
+	}
+
+	return nil
+}
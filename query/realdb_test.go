@@ -163,6 +163,14 @@ var realDBTestCases = []realDBTestCase{
 		query:         "child.name $exists true",
 		expectedItems: testItems[2:3],
 	},
+	{
+		query:         "not num >= 2",
+		expectedItems: testItems[:1],
+	},
+	{
+		query:         "not (num = 1 or name = \"item3\")",
+		expectedItems: testItems[1:2],
+	},
 }
 
 func TestDB_FindMany(t *testing.T) {
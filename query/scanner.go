@@ -3,9 +3,15 @@ package query
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"unicode"
+	"unicode/utf8"
 )
 
+// ErrCommentNotClosed is returned when block comment is not closed.
+var ErrCommentNotClosed = errors.New("comment is not closed")
+
 type Token uint
 
 const (
@@ -17,10 +23,22 @@ const (
 	TRegex
 	TBool
 	TComma
+	TArith
+	TColon
+	// TNumberUnit is a number with unit suffix like 7d or 1.5km.
+	TNumberUnit
+	// TQuestion is a mark of optional clause.
+	TQuestion
+	// TMacro is a reference to named query fragment like @active,
+	// literal is a name without @.
+	TMacro
+	// TJSON is a text of JSON(...) fragment as is.
+	TJSON
 )
 
 var PrimitiveTypes = []Token{
 	TNumber,
+	TNumberUnit,
 	TString,
 	TRegex,
 	TBool,
@@ -69,8 +87,24 @@ type Scanner struct {
 	tok    Token
 	lit    []byte
 	match  func(byte) bool
+	// operand is true if last token can be followed by
+	// arithmetic operator (it helps to distinguish division and regex).
+	operand bool
+	// json is a state of JSON(...) fragment, text after its opening
+	// parenthesis is read as is.
+	json jsonState
 }
 
+type jsonState uint
+
+const (
+	jsonNone jsonState = iota
+	// jsonKey is after JSON key.
+	jsonKey
+	// jsonText is after opening parenthesis of JSON.
+	jsonText
+)
+
 func (s *Scanner) Token() (Token, []byte) {
 	return s.tok, s.lit
 }
@@ -80,6 +114,48 @@ func (s *Scanner) Position() (int, int) {
 }
 
 func (s *Scanner) Next() error {
+	var err error
+
+	if s.json == jsonText {
+		err = s.readJSON()
+	} else {
+		err = s.next()
+	}
+
+	s.json = s.jsonState()
+	s.operand = s.isOperand()
+
+	return err
+}
+
+func (s *Scanner) jsonState() jsonState {
+	switch {
+	case s.tok == TKey && bytes.Equal(s.lit, keyFuncJSON):
+		return jsonKey
+	case s.json == jsonKey && s.tok == TParentheses && s.lit[0] == '(':
+		return jsonText
+	}
+
+	return jsonNone
+}
+
+func (s *Scanner) isOperand() bool {
+	switch s.tok {
+	case TNumber, TNumberUnit, TString, TBool:
+		return true
+	case TKey:
+		// operators like $regex or $gt are followed by operand,
+		// parameters are operands itself
+		_, op := operators[string(s.lit)]
+		return !op
+	case TParentheses:
+		return s.lit[0] == ')' || s.lit[0] == ']' || s.lit[0] == '}'
+	}
+
+	return false
+}
+
+func (s *Scanner) next() error {
 	s.lit = s.lit[:0]
 	s.tok = 0
 
@@ -93,9 +169,24 @@ func (s *Scanner) Next() error {
 
 		for ; s.bufPos < s.bufLen; s.bufPos++ {
 			c := s.buf[s.bufPos]
+			if isCommentStart(c) {
+				skipped, err := s.skipComment()
+				if err != nil {
+					return err
+				}
+
+				if skipped {
+					// loop moves to symbol after comment
+					s.bufPos--
+					continue
+				}
+
+				c = s.buf[s.bufPos]
+			}
+
 			switch {
-			case isKey(c):
-				s.match = isKey
+			case isKeyStart(c):
+				s.match = keyMatcher()
 				s.tok = TKey
 				err := s.read()
 				if err != nil {
@@ -106,23 +197,31 @@ func (s *Scanner) Next() error {
 					s.tok = TBool
 				}
 
-				return nil
+				return checkKey(s.lit)
+			case isQuotedKey(c):
+				s.tok = TKey
+				return s.readString(c)
 			case isOp(c):
 				s.match = isOp
 				s.tok = TOp
 				return s.read()
-			case isNumber(c):
-				s.match = isNumber
+			case isNumber(c) || (isSign(c) && !s.operand):
 				s.tok = TNumber
-				return s.read()
+				return s.readNumber()
 			case isString(c):
 				s.match = isString
 				s.tok = TString
 				return s.readString(c)
-			case isRegex(c):
+			case isRegex(c) && !s.operand:
 				s.match = isRegex
 				s.tok = TRegex
 				return s.readRegex()
+			case isArith(c):
+				s.tok = TArith
+				s.lit = append(s.lit, c)
+				s.pos.c++
+				s.bufPos++
+				return nil
 			case isParentheses(c):
 				s.tok = TParentheses
 				s.lit = append(s.lit, c)
@@ -135,6 +234,32 @@ func (s *Scanner) Next() error {
 				s.pos.c++
 				s.bufPos++
 				return nil
+			case isColon(c):
+				s.tok = TColon
+				s.lit = append(s.lit, c)
+				s.pos.c++
+				s.bufPos++
+				return nil
+			case isMacro(c):
+				s.match = isMacroName
+				s.tok = TMacro
+				s.pos.c++
+				s.bufPos++
+
+				err := s.read()
+				if errors.Is(err, io.EOF) {
+					// `@` at the end is reference without name,
+					// parser reports it
+					return nil
+				}
+
+				return err
+			case isQuestion(c):
+				s.tok = TQuestion
+				s.lit = append(s.lit, c)
+				s.pos.c++
+				s.bufPos++
+				return nil
 			case c == '\n':
 				s.pos.l++
 				s.pos.c = 0
@@ -154,7 +279,9 @@ func (s *Scanner) read() error {
 				break
 			}
 
-			s.pos.c++
+			if !isContinuation(s.buf[s.bufPos]) {
+				s.pos.c++
+			}
 		}
 
 		s.lit = append(s.lit, s.buf[start:s.bufPos]...)
@@ -179,6 +306,216 @@ func (s *Scanner) read() error {
 	return nil
 }
 
+// readNumber reads number literal with optional sign, like 12, -1_000,
+// 1.5, 1e-6 or 0xFF. Sign not followed by number is read as TArith.
+// Number followed by letters is read as TNumberUnit.
+func (s *Scanner) readNumber() error {
+	c := s.buf[s.bufPos]
+	if isSign(c) {
+		s.lit = append(s.lit, c)
+		s.pos.c++
+		s.bufPos++
+
+		if s.bufPos == s.bufLen {
+			err := s.advance()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					s.tok = TArith
+					return nil
+				}
+
+				return err
+			}
+		}
+
+		if !isNumber(s.buf[s.bufPos]) {
+			s.tok = TArith
+			return nil
+		}
+	}
+
+	s.match = numberMatcher()
+	err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if s.bufPos < s.bufLen && isLetter(s.buf[s.bufPos]) {
+		s.tok = TNumberUnit
+		s.match = isUnit
+		return s.read()
+	}
+
+	return nil
+}
+
+func isLetter(s byte) bool {
+	return (s >= 'a' && s <= 'z') || (s >= 'A' && s <= 'Z')
+}
+
+// isUnit matches unit suffix of number, it may contain
+// several numbers with units like 1h30m.
+func isUnit(s byte) bool {
+	return isLetter(s) || isNumber(s)
+}
+
+// numberMatcher returns matcher of number literal symbols, exponent sign
+// is matched only after 'e' and hex digits only after 0x prefix.
+// Literal is validated by parser.
+func numberMatcher() func(byte) bool {
+	var prev byte
+	n := 0
+	hex := false
+
+	return func(c byte) bool {
+		ok := false
+
+		switch {
+		case (c >= '0' && c <= '9') || c == '_':
+			ok = true
+		case (c == 'x' || c == 'X') && n == 1 && prev == '0':
+			ok, hex = true, true
+		case hex:
+			ok = (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+		case c == '.' || c == 'e' || c == 'E':
+			ok = true
+		case isSign(c):
+			ok = prev == 'e' || prev == 'E'
+		}
+
+		if ok {
+			prev = c
+			n++
+		}
+
+		return ok
+	}
+}
+
+// skipComment skips `// line`, `-- line` or `/* block */` comment
+// at current symbol, it reports false if there is no comment.
+// Line comment is skipped up to (not including) line break.
+func (s *Scanner) skipComment() (bool, error) {
+	c := s.buf[s.bufPos]
+
+	nc, ok, err := s.peek()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	block := c == '/' && nc == '*'
+	if !block && nc != c {
+		return false, nil
+	}
+
+	s.bufPos += 2
+	s.pos.c += 2
+
+	var prev byte
+
+	for {
+		if s.bufPos == s.bufLen {
+			err := s.advance()
+			if err != nil {
+				if block && errors.Is(err, io.EOF) {
+					return false, ErrCommentNotClosed
+				}
+
+				return false, err
+			}
+		}
+
+		c = s.buf[s.bufPos]
+
+		switch {
+		case c == '\n' && !block:
+			return true, nil
+		case c == '\n':
+			s.pos.l++
+			s.pos.c = 0
+		case block && prev == '*' && c == '/':
+			s.pos.c++
+			s.bufPos++
+			return true, nil
+		case !isContinuation(c):
+			s.pos.c++
+		}
+
+		prev = c
+		s.bufPos++
+	}
+}
+
+// readJSON reads text of JSON(...) fragment up to closing parenthesis,
+// parentheses within JSON strings are skipped.
+func (s *Scanner) readJSON() error {
+	s.lit = s.lit[:0]
+	s.tok = TJSON
+
+	var quoted, escaped bool
+
+	for {
+		if s.bufPos == s.bufLen {
+			err := s.advance()
+			if err != nil {
+				return err
+			}
+		}
+
+		c := s.buf[s.bufPos]
+
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == ')':
+			return nil
+		}
+
+		switch {
+		case c == '\n':
+			s.pos.l++
+			s.pos.c = 0
+		case !isContinuation(c):
+			s.pos.c++
+		}
+
+		s.lit = append(s.lit, c)
+		s.bufPos++
+	}
+}
+
+// peek returns symbol following current one, if it is not in buffer
+// current symbol is moved to the start of buffer and rest is refilled.
+func (s *Scanner) peek() (byte, bool, error) {
+	if s.bufPos+1 < s.bufLen {
+		return s.buf[s.bufPos+1], true, nil
+	}
+
+	s.buf[0] = s.buf[s.bufPos]
+	n, err := io.ReadFull(s.src, s.buf[1:])
+
+	s.bufPos = 0
+	s.bufLen = n + 1
+
+	if n == 0 {
+		if errors.Is(err, io.EOF) {
+			return 0, false, nil
+		}
+
+		return 0, false, err
+	}
+
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, false, err
+	}
+
+	return s.buf[1], true, nil
+}
+
 func (s *Scanner) readRegex() error {
 	err := s.readString('/')
 	if err != nil {
@@ -199,6 +536,7 @@ func (s *Scanner) readRegex() error {
 
 func (s *Scanner) readString(quoteSym byte) error {
 	s.lit = append(s.lit, quoteSym)
+	s.pos.c++
 	s.bufPos++
 
 	for {
@@ -212,7 +550,7 @@ func (s *Scanner) readString(quoteSym byte) error {
 		closePos := bytes.IndexByte(s.buf[s.bufPos:s.bufLen], quoteSym)
 		if closePos == -1 {
 			s.lit = append(s.lit, s.buf[s.bufPos:s.bufLen]...)
-			s.pos.c += (s.bufLen - s.bufPos)
+			s.pos.c += columns(s.buf[s.bufPos:s.bufLen])
 			s.bufPos = s.bufLen
 			continue
 		}
@@ -222,29 +560,33 @@ func (s *Scanner) readString(quoteSym byte) error {
 		// check for escaped ", example: "\\\""
 		sc := s.countSlashBack(closeBuffPos - 1)
 		if sc != 0 && sc%2 != 0 {
+			s.lit = append(s.lit, s.buf[s.bufPos:closeBuffPos+1]...)
+			s.pos.c += columns(s.buf[s.bufPos : closeBuffPos+1])
 			s.bufPos = closeBuffPos + 1
 			continue
 		}
 
 		s.lit = append(s.lit, s.buf[s.bufPos:closeBuffPos+1]...)
-		s.pos.c += closeBuffPos + 1 - s.bufPos
+		s.pos.c += columns(s.buf[s.bufPos : closeBuffPos+1])
 		s.bufPos = closeBuffPos + 1
 		return nil
 	}
 }
 
+// countSlashBack counts backslashes before quote at p,
+// symbols before bufPos are already in lit.
 func (s *Scanner) countSlashBack(p int) int {
 	c := 0
 
 	i := p
-	for ; i >= 0; i-- {
+	for ; i >= s.bufPos; i-- {
 		if s.buf[i] != '\\' {
 			break
 		}
 		c++
 	}
 
-	if i == -1 {
+	if i < s.bufPos {
 		for j := len(s.lit) - 1; j >= 0; j-- {
 			if s.lit[j] != '\\' {
 				break
@@ -273,17 +615,96 @@ func (s *Scanner) advance() error {
 	return err
 }
 
+func isKeyStart(s byte) bool {
+	return s != '-' && s != '.' && !isDigit(s) && isKey(s)
+}
+
+// isKey matches key symbols, non ASCII bytes are parts of
+// UTF-8 encoded letters and checked by checkKey.
 func isKey(s byte) bool {
 	return (s >= 'a' && s <= 'z') ||
 		(s >= 'A' && s <= 'Z') ||
+		isDigit(s) ||
 		s == '_' ||
 		s == '.' ||
 		s == '-' ||
-		s == '$'
+		s == '$' ||
+		s >= utf8.RuneSelf
+}
+
+// keyMatcher returns matcher of key symbols, it also matches
+// positional operators `$[]` and `$[id]` in path like `items.$[].price`.
+func keyMatcher() func(byte) bool {
+	var prev, prev2 byte
+	bracket := false
+
+	return func(c byte) bool {
+		ok := false
+
+		switch {
+		case bracket:
+			ok = c == ']' || isLetter(c) || isDigit(c) || c == '_'
+			bracket = c != ']'
+		case c == '[':
+			ok = prev == '$' && prev2 == '.'
+			bracket = ok
+		default:
+			ok = isKey(c)
+		}
+
+		if ok {
+			prev2, prev = prev, c
+		}
+
+		return ok
+	}
+}
+
+// checkKey checks that non ASCII symbols of key are letters or digits.
+func checkKey(key []byte) error {
+	if utf8.Valid(key) && bytes.IndexFunc(key, func(r rune) bool {
+		return r >= utf8.RuneSelf && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	}) == -1 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid symbol in key %s", key)
+}
+
+// isQuotedKey matches start of back-quoted key like `order`
+// which may contain any symbols and is never a keyword.
+func isQuotedKey(s byte) bool {
+	return s == '`'
+}
+
+// isContinuation matches continuation bytes of UTF-8 encoded symbol.
+func isContinuation(s byte) bool {
+	return s&0xC0 == 0x80
+}
+
+// columns returns number of symbols in UTF-8 text.
+func columns(b []byte) int {
+	n := 0
+
+	for _, c := range b {
+		if !isContinuation(c) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func isDigit(s byte) bool {
+	return s >= '0' && s <= '9'
 }
 
 func isOp(s byte) bool {
-	return bytes.IndexByte([]byte("<>=!"), s) >= 0
+	return bytes.IndexByte([]byte("<>=!~"), s) >= 0
+}
+
+func isArith(s byte) bool {
+	return bytes.IndexByte([]byte("+-*/%"), s) >= 0
 }
 
 func isNumber(s byte) bool {
@@ -291,10 +712,18 @@ func isNumber(s byte) bool {
 		s == '.'
 }
 
+func isSign(s byte) bool {
+	return s == '-' || s == '+'
+}
+
 func isString(s byte) bool {
 	return s == '"' || s == '\''
 }
 
+func isCommentStart(s byte) bool {
+	return s == '/' || s == '-'
+}
+
 func isRegex(s byte) bool {
 	return s == '/'
 }
@@ -303,13 +732,31 @@ func isParentheses(s byte) bool {
 	return s == '(' ||
 		s == ')' ||
 		s == '[' ||
-		s == ']'
+		s == ']' ||
+		s == '{' ||
+		s == '}'
 }
 
 func isComma(s byte) bool {
 	return s == ','
 }
 
+func isColon(s byte) bool {
+	return s == ':'
+}
+
+func isQuestion(s byte) bool {
+	return s == '?'
+}
+
+func isMacro(s byte) bool {
+	return s == '@'
+}
+
+func isMacroName(s byte) bool {
+	return isLetter(s) || isDigit(s) || s == '_'
+}
+
 func isBool(l []byte) bool {
 	return bytes.EqualFold(l, []byte("true")) ||
 		bytes.EqualFold(l, []byte("false"))
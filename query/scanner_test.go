@@ -45,3 +45,257 @@ func TestScanner(t *testing.T) {
 		t.Fatal("unexpected position", l, c)
 	}
 }
+
+func TestScanner_Arithmetic(t *testing.T) {
+	src := `a/2 > b - c*d%3 and e $regex /x/ and f = /y/i + 1`
+
+	exp := []string{
+		"a", "/", "2", ">", "b", "-", "c", "*", "d", "%", "3",
+		"and", "e", "$regex", "/x/", "and", "f", "=", "/y/i", "+", "1",
+	}
+
+	s := query.NewScanner(strings.NewReader(src))
+
+	i := 0
+	for s.Next() == nil {
+		_, l := s.Token()
+		if string(l) != exp[i] {
+			t.Fatalf("unexpected literal got: '%s'; expected: '%s'", string(l), exp[i])
+		}
+		i++
+	}
+
+	if i < len(exp) {
+		t.Fatal("not all tokens read", i, len(exp))
+	}
+}
+
+func TestScanner_Numbers(t *testing.T) {
+	src := `a > -5 and b in [-1, +2.5, 1e-6, 0xFF, 1_000] and c - 1 < d -2 and e - -3 and f = .5`
+
+	exp := []string{
+		"a", ">", "-5", "and", "b", "in", "[", "-1", ",", "+2.5", ",", "1e-6", ",", "0xFF", ",", "1_000", "]",
+		"and", "c", "-", "1", "<", "d", "-", "2", "and", "e", "-", "-3", "and", "f", "=", ".5",
+	}
+
+	s := query.NewScanner(strings.NewReader(src))
+
+	i := 0
+	for s.Next() == nil {
+		_, l := s.Token()
+		if string(l) != exp[i] {
+			t.Fatalf("unexpected literal got: '%s'; expected: '%s'", string(l), exp[i])
+		}
+		i++
+	}
+
+	if i < len(exp) {
+		t.Fatal("not all tokens read", i, len(exp))
+	}
+}
+
+func TestScanner_Durations(t *testing.T) {
+	src := `a > NOW() - 7d and b < $start + 1h30m and c = 1.5km`
+
+	exp := []string{
+		"a", ">", "NOW", "(", ")", "-", "7d", "and", "b", "<", "$start", "+", "1h30m",
+		"and", "c", "=", "1.5km",
+	}
+
+	s := query.NewScanner(strings.NewReader(src))
+
+	i := 0
+	for s.Next() == nil {
+		tok, l := s.Token()
+		if string(l) != exp[i] {
+			t.Fatalf("unexpected literal got: '%s'; expected: '%s'", string(l), exp[i])
+		}
+
+		if (exp[i] == "7d" || exp[i] == "1h30m") && tok != query.TNumberUnit {
+			t.Fatalf("unexpected token for '%s': %v", exp[i], tok)
+		}
+		i++
+	}
+
+	if i < len(exp) {
+		t.Fatal("not all tokens read", i, len(exp))
+	}
+}
+
+func TestScanner_Comments(t *testing.T) {
+	src := "// header\na > 1 -- line\n/* block\ncomment */ and b = /x/ // tail"
+
+	exp := []struct {
+		lit       string
+		line, col int
+	}{
+		{"a", 2, 2},
+		{">", 2, 4},
+		{"1", 2, 6},
+		{"and", 4, 15},
+		{"b", 4, 17},
+		{"=", 4, 19},
+		{"/x/", 4, 23},
+	}
+
+	s := query.NewScanner(strings.NewReader(src))
+
+	i := 0
+	for s.Next() == nil {
+		_, l := s.Token()
+		if string(l) != exp[i].lit {
+			t.Fatalf("unexpected literal got: '%s'; expected: '%s'", string(l), exp[i].lit)
+		}
+
+		line, col := s.Position()
+		if line != exp[i].line || col != exp[i].col {
+			t.Fatalf("unexpected position of '%s' got: %d:%d; expected: %d:%d",
+				l, line, col, exp[i].line, exp[i].col)
+		}
+		i++
+	}
+
+	if i < len(exp) {
+		t.Fatal("not all tokens read", i, len(exp))
+	}
+}
+
+func TestScanner_Keys(t *testing.T) {
+	src := "address2 = 1 and имя = 2 and `first name` > items.$[].qty and a.$[x].b = 3"
+
+	exp := []struct {
+		lit string
+		tok query.Token
+	}{
+		{"address2", query.TKey},
+		{"=", query.TOp},
+		{"1", query.TNumber},
+		{"and", query.TKey},
+		{"имя", query.TKey},
+		{"=", query.TOp},
+		{"2", query.TNumber},
+		{"and", query.TKey},
+		{"`first name`", query.TKey},
+		{">", query.TOp},
+		{"items.$[].qty", query.TKey},
+		{"and", query.TKey},
+		{"a.$[x].b", query.TKey},
+		{"=", query.TOp},
+		{"3", query.TNumber},
+	}
+
+	s := query.NewScanner(strings.NewReader(src))
+
+	i := 0
+	for s.Next() == nil {
+		tok, l := s.Token()
+		if string(l) != exp[i].lit || tok != exp[i].tok {
+			t.Fatalf("unexpected token got: '%s' (%d); expected: '%s' (%d)", l, tok, exp[i].lit, exp[i].tok)
+		}
+		i++
+	}
+
+	if i < len(exp) {
+		t.Fatal("not all tokens read", i, len(exp))
+	}
+
+	_, col := s.Position()
+	if col != 75 {
+		t.Fatal("unexpected column", col)
+	}
+}
+
+func TestScanner_Strings(t *testing.T) {
+	src := `a = "long string with \"quoted\" words" and b = 'it\'s'`
+
+	exp := []string{
+		"a", "=", `"long string with \"quoted\" words"`, "and", "b", "=", `'it\'s'`,
+	}
+
+	s := query.NewScanner(strings.NewReader(src))
+
+	i := 0
+	for s.Next() == nil {
+		_, l := s.Token()
+		if string(l) != exp[i] {
+			t.Fatalf("unexpected literal got: '%s'; expected: '%s'", string(l), exp[i])
+		}
+		i++
+	}
+
+	if i < len(exp) {
+		t.Fatal("not all tokens read", i, len(exp))
+	}
+}
+
+func TestScanner_Macros(t *testing.T) {
+	src := `@active and not @is_new2 or a = 1`
+
+	exp := []struct {
+		tok query.Token
+		lit string
+	}{
+		{query.TMacro, "active"},
+		{query.TKey, "and"},
+		{query.TKey, "not"},
+		{query.TMacro, "is_new2"},
+		{query.TKey, "or"},
+		{query.TKey, "a"},
+		{query.TOp, "="},
+		{query.TNumber, "1"},
+	}
+
+	s := query.NewScanner(strings.NewReader(src))
+
+	i := 0
+	for s.Next() == nil {
+		tok, l := s.Token()
+		if tok != exp[i].tok || string(l) != exp[i].lit {
+			t.Fatalf("unexpected token got: %v '%s'; expected: %v '%s'", tok, l, exp[i].tok, exp[i].lit)
+		}
+		i++
+	}
+
+	if i < len(exp) {
+		t.Fatal("not all tokens read", i, len(exp))
+	}
+}
+
+func TestScanner_JSON(t *testing.T) {
+	src := `JSON({"a": "x) -- @b"}) and c JSON ( {"$gt": 1} ) and JSON = 1`
+
+	exp := []struct {
+		tok query.Token
+		lit string
+	}{
+		{query.TKey, "JSON"},
+		{query.TParentheses, "("},
+		{query.TJSON, `{"a": "x) -- @b"}`},
+		{query.TParentheses, ")"},
+		{query.TKey, "and"},
+		{query.TKey, "c"},
+		{query.TKey, "JSON"},
+		{query.TParentheses, "("},
+		{query.TJSON, ` {"$gt": 1} `},
+		{query.TParentheses, ")"},
+		{query.TKey, "and"},
+		{query.TKey, "JSON"},
+		{query.TOp, "="},
+		{query.TNumber, "1"},
+	}
+
+	s := query.NewScanner(strings.NewReader(src))
+
+	i := 0
+	for s.Next() == nil {
+		tok, l := s.Token()
+		if tok != exp[i].tok || string(l) != exp[i].lit {
+			t.Fatalf("unexpected token got: %v '%s'; expected: %v '%s'", tok, l, exp[i].tok, exp[i].lit)
+		}
+		i++
+	}
+
+	if i < len(exp) {
+		t.Fatal("not all tokens read", i, len(exp))
+	}
+}